@@ -0,0 +1,437 @@
+package cargosnip
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Dependency is the structured form of one dependency declaration, in
+// either the `foo = "1.2"` or the table form.
+type Dependency struct {
+	Name            string
+	Version         string
+	Features        []string
+	Optional        bool
+	Git             string
+	Branch          string
+	Tag             string
+	Rev             string
+	Path            string
+	Package         string
+	DefaultFeatures bool
+	Workspace       bool // inherited from the root [workspace.dependencies]
+
+	// Comments are the comment lines directly above the declaration, without
+	// their leading "#", e.g. "needed for TLS". Commented-out declarations
+	// are left out.
+	Comments []string
+}
+
+// GitRef describes which revision a git dependency pins, e.g. "branch main",
+// "tag v1.0" or "rev 1a2b3c", or "" when it follows the default branch.
+func (d Dependency) GitRef() string {
+	switch {
+	case d.Rev != "":
+		return "rev " + d.Rev
+	case d.Tag != "":
+		return "tag " + d.Tag
+	case d.Branch != "":
+		return "branch " + d.Branch
+	}
+	return ""
+}
+
+// ParseDependencyLine parses a single-line dependency declaration such as
+// `serde = "1.0"`, `serde = { version = "1.0", features = ["derive"] }` or
+// `serde.workspace = true`. Keys other than the Dependency fields are
+// accepted and ignored.
+func ParseDependencyLine(line string) (Dependency, error) {
+	keys, value, rest, err := ParseKeyValue(line)
+	if err != nil {
+		return Dependency{}, err
+	}
+	if rest = SkipSpace(rest); rest != "" {
+		return Dependency{}, fmt.Errorf("unexpected %q after dependency value", rest)
+	}
+
+	dep := Dependency{Name: keys[0], DefaultFeatures: true}
+	return dep, dep.apply(keys[1:], value)
+}
+
+// parseDottedDependency parses the consecutive lines of one dependency
+// declared with dotted keys, such as
+//
+//	tokio.workspace = true
+//	tokio.features = ["full"]
+//
+// applying each line in turn. A single line of any form is accepted too.
+func parseDottedDependency(text string) (Dependency, error) {
+	var dep Dependency
+	for rest := SkipSpace(text); rest != ""; rest = SkipSpace(rest) {
+		keys, value, next, err := ParseKeyValue(rest)
+		if err != nil {
+			return dep, err
+		}
+		switch {
+		case dep.Name == "":
+			dep = Dependency{Name: keys[0], DefaultFeatures: true}
+		case keys[0] != dep.Name || len(keys) == 1:
+			return dep, fmt.Errorf("dependency %s: unexpected key %s", dep.Name, strings.Join(keys, "."))
+		}
+		if err := dep.apply(keys[1:], value); err != nil {
+			return dep, err
+		}
+		rest = next
+	}
+	return dep, nil
+}
+
+// apply stores the value of one declaration line whose key, after the
+// crate name, is keys: the whole declaration when keys is empty, or one
+// field of it in the dotted form, e.g. serde.version = "1.0".
+func (d *Dependency) apply(keys []string, value any) error {
+	if len(keys) > 0 {
+		return d.setField(strings.Join(keys, "."), value)
+	}
+	switch v := value.(type) {
+	case string:
+		d.Version = v
+		return nil
+	case map[string]any:
+		for key, fieldValue := range v {
+			if err := d.setField(key, fieldValue); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("dependency %s: unsupported value %v", d.Name, value)
+}
+
+// ParseDependencySubtable parses a dependency declared as its own table,
+// such as
+//
+//	[dependencies.tokio]
+//	version = "1"
+//	default-features = false
+//
+// into the same Dependency as the inline form
+// `tokio = { version = "1", default-features = false }`. The crate name is
+// the last key of the header.
+func ParseDependencySubtable(table string) (Dependency, error) {
+	header, body, _ := strings.Cut(strings.TrimLeft(table, " \t\n"), "\n")
+	parsed, ok := ParseTableHeader(strings.TrimSpace(header))
+	if !ok {
+		return Dependency{}, fmt.Errorf("dependency subtable must start with a table header, got %q", header)
+	}
+	return parseDependencySubtableBody(parsed.Keys[len(parsed.Keys)-1], body)
+}
+
+// parseDependencySubtableBody parses the key/value lines below a
+// [<section>.<crate>] header into a Dependency named name.
+func parseDependencySubtableBody(name, body string) (Dependency, error) {
+	dep := Dependency{Name: name, DefaultFeatures: true}
+	for rest := SkipSpace(body); rest != ""; rest = SkipSpace(rest) {
+		keys, value, next, err := ParseKeyValue(rest)
+		if err != nil {
+			return dep, err
+		}
+		if err := dep.setField(strings.Join(keys, "."), value); err != nil {
+			return dep, err
+		}
+		rest = next
+	}
+	return dep, nil
+}
+
+// setField stores one table field of a dependency declaration.
+func (d *Dependency) setField(key string, value any) error {
+	var ok bool
+	switch key {
+	case "version":
+		d.Version, ok = value.(string)
+	case "git":
+		d.Git, ok = value.(string)
+	case "branch":
+		d.Branch, ok = value.(string)
+	case "tag":
+		d.Tag, ok = value.(string)
+	case "rev":
+		d.Rev, ok = value.(string)
+	case "path":
+		d.Path, ok = value.(string)
+	case "package":
+		d.Package, ok = value.(string)
+	case "optional":
+		d.Optional, ok = value.(bool)
+	case "workspace":
+		d.Workspace, ok = value.(bool)
+	case "default-features", "default_features":
+		d.DefaultFeatures, ok = value.(bool)
+	case "features":
+		var items []any
+		if items, ok = value.([]any); ok {
+			d.Features = d.Features[:0]
+			for _, item := range items {
+				feature, isString := item.(string)
+				if !isString {
+					return fmt.Errorf("dependency %s: non-string feature %v", d.Name, item)
+				}
+				d.Features = append(d.Features, feature)
+			}
+		}
+	default:
+		return nil
+	}
+	if !ok {
+		return fmt.Errorf("dependency %s: unexpected value %v for %s", d.Name, value, key)
+	}
+	return nil
+}
+
+// Entry is one logical entry of a dependency group: a key/value pair
+// (possibly spanning lines) or a [<section>.<crate>] subtable, together with
+// the comment lines directly above it.
+type Entry struct {
+	Name  string   // crate name, "" for lines outside any entry
+	Lines []string // trimmed, whitespace runs collapsed
+	Raw   []string // the same lines as they appear in the group
+}
+
+// SplitEntries splits a dependency group into its logical entries.
+// Consecutive dotted-key lines of the same crate, like `serde.version = "1"`
+// followed by `serde.features = ["derive"]`, form a single entry.
+func SplitEntries(content string) []Entry {
+	var entries []Entry
+	var comments, rawComments []string
+	var scanner LineScanner
+	inSubtable := false
+	lastDotted := false // the last entry was declared with dotted keys
+
+	for _, line := range strings.Split(content, "\n") {
+		stripped := collapseWhitespace(strings.TrimSpace(line))
+		topLevel := scanner.AtTopLevel()
+		scanner.Scan(line)
+
+		switch {
+		case stripped == "":
+			// Blank lines inside a multi-line string only matter to raw
+			if !topLevel && len(entries) > 0 {
+				last := &entries[len(entries)-1]
+				last.Raw = append(last.Raw, line)
+			}
+			continue
+		case !topLevel:
+			// Continuation of a multi-line value
+		case strings.HasPrefix(stripped, "#"):
+			comments = append(comments, stripped)
+			rawComments = append(rawComments, line)
+			continue
+		default:
+			if header, ok := ParseTableHeader(stripped); ok {
+				inSubtable = true
+				name := header.Keys[len(header.Keys)-1]
+				entries = append(entries, Entry{Name: name, Lines: comments, Raw: rawComments})
+				comments, rawComments = nil, nil
+			} else if !inSubtable || len(entries) == 0 {
+				name, rest, ok := parseKey(stripped)
+				if !ok {
+					name = stripped
+				}
+				// Consecutive dotted lines of one crate are one declaration
+				dotted := ok && strings.HasPrefix(strings.TrimLeft(rest, " "), ".")
+				if !dotted || !lastDotted || entries[len(entries)-1].Name != name {
+					entries = append(entries, Entry{Name: name, Lines: comments, Raw: rawComments})
+					comments, rawComments = nil, nil
+				}
+				lastDotted = dotted
+			}
+		}
+
+		if len(entries) == 0 {
+			entries = append(entries, Entry{})
+		}
+		last := &entries[len(entries)-1]
+		last.Lines = append(last.Lines, comments...)
+		last.Lines = append(last.Lines, stripped)
+		last.Raw = append(last.Raw, rawComments...)
+		last.Raw = append(last.Raw, line)
+		comments, rawComments = nil, nil
+	}
+
+	// Trailing comments stay with the last entry
+	if len(comments) > 0 {
+		if len(entries) == 0 {
+			entries = append(entries, Entry{})
+		}
+		last := &entries[len(entries)-1]
+		last.Lines = append(last.Lines, comments...)
+		last.Raw = append(last.Raw, rawComments...)
+	}
+
+	return entries
+}
+
+// Dependency parses the entry into a Dependency, handling the single-line
+// form, consecutive dotted-key lines and [<section>.<crate>] subtables.
+func (e Entry) Dependency() (Dependency, error) {
+	var body, comments []string
+	for _, line := range e.Lines {
+		switch {
+		case !strings.HasPrefix(line, "#"):
+			body = append(body, line)
+		case len(body) == 0:
+			// Commented-out declarations are not a rationale
+			text := strings.TrimSpace(strings.TrimLeft(line, "#"))
+			if _, _, _, err := ParseKeyValue(text); err != nil && text != "" {
+				comments = append(comments, text)
+			}
+		}
+	}
+	if len(body) == 0 {
+		return Dependency{}, fmt.Errorf("dependency %s has no declaration", e.Name)
+	}
+
+	var dep Dependency
+	var err error
+	if _, ok := ParseTableHeader(body[0]); ok {
+		dep, err = ParseDependencySubtable(strings.Join(body, "\n"))
+	} else {
+		dep, err = parseDottedDependency(strings.Join(body, "\n"))
+	}
+	dep.Comments = comments
+	return dep, err
+}
+
+// Version returns the version requirement declared by the entry, or "" when
+// it has none or cannot be parsed.
+func (e Entry) Version() string {
+	dep, err := e.Dependency()
+	if err != nil {
+		return ""
+	}
+	return dep.Version
+}
+
+// canonical returns the lines of the entry with its key/value pairs
+// re-rendered from their parsed form, so spacing, quote style and the key
+// order of inline tables do not matter: `serde = {version="1"}` and
+// `serde = { version = "1" }` come out the same. A [<section>.<crate>]
+// subtable and consecutive dotted-key lines are rendered as the equivalent
+// inline table, so they hash like the inline form. Comments are kept ahead of the declaration. Entries that
+// do not parse keep their collapsed lines.
+func (e Entry) canonical() []string {
+	var comments, body []string
+	for _, line := range e.Lines {
+		if strings.HasPrefix(line, "#") {
+			comments = append(comments, line)
+		} else {
+			body = append(body, line)
+		}
+	}
+	if len(body) == 0 {
+		return e.Lines
+	}
+
+	canonical := comments
+	if _, ok := ParseTableHeader(body[0]); ok {
+		table, err := parseTable(strings.Join(body[1:], "\n"))
+		if err != nil {
+			return e.Lines
+		}
+		return append(canonical, formatKey(e.Name)+" = "+formatValue(table))
+	}
+	table, err := parseTable(strings.Join(body, "\n"))
+	if err != nil {
+		return e.Lines
+	}
+	keys := make([]string, 0, len(table))
+	for key := range table {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		canonical = append(canonical, formatKey(key)+" = "+formatValue(table[key]))
+	}
+	return canonical
+}
+
+// CanonicalText returns the form of a dependency group that is hashed: each
+// entry in its canonical form (see Entry.canonical), and entries sorted by
+// crate name so declaration order does not affect dedup. Lines are trimmed
+// first, so tab- and space-indented groups hash the same. Snippet files keep
+// the original text; only the hash uses this form.
+func CanonicalText(content string) string {
+	entries := SplitEntries(content)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+
+	var canonical []string
+	for _, entry := range entries {
+		canonical = append(canonical, entry.canonical()...)
+	}
+	return strings.Join(canonical, "\n")
+}
+
+// ComputeContentHash returns the SHA-256 of the canonical form of a
+// dependency group (see CanonicalText), ignoring snippet header comments.
+// Blank lines between entries and surrounding whitespace on each line do not
+// reach the canonical form, so groups that differ only in that formatting
+// share a hash; the text inside multi-line strings is kept as is.
+func ComputeContentHash(content string) string {
+	lines := strings.Split(content, "\n")
+	var contentLines []string
+
+	for _, line := range lines {
+		stripped := strings.TrimSpace(line)
+		// Skip metadata comments at the start
+		if strings.HasPrefix(stripped, "# Source:") ||
+			strings.HasPrefix(stripped, "# Section:") ||
+			strings.HasPrefix(stripped, "# Auto-generated") {
+			continue
+		}
+		contentLines = append(contentLines, line)
+	}
+
+	cleanContent := CanonicalText(strings.Join(contentLines, "\n"))
+	hash := sha256.Sum256([]byte(cleanContent))
+	return hex.EncodeToString(hash[:])
+}
+
+// collapseWhitespace replaces runs of spaces and tabs outside quoted strings
+// with a single space.
+func collapseWhitespace(line string) string {
+	var sb strings.Builder
+	var quote byte
+	lastSpace := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if quote != 0 {
+			sb.WriteByte(c)
+			if c == '\\' && quote == '"' && i+1 < len(line) {
+				i++
+				sb.WriteByte(line[i])
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		if c == ' ' || c == '\t' {
+			if !lastSpace {
+				sb.WriteByte(' ')
+			}
+			lastSpace = true
+			continue
+		}
+		lastSpace = false
+		if c == '"' || c == '\'' {
+			quote = c
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
@@ -0,0 +1,217 @@
+package cargosnip
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCanonicalTextIgnoresTabs(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		groups []string
+	}{
+		{
+			name: "indentation",
+			groups: []string{
+				"serde = \"1\"\ntokio = \"1\"",
+				"\tserde = \"1\"\n\ttokio = \"1\"",
+				"  serde = \"1\"\n\t  tokio = \"1\"",
+			},
+		},
+		{
+			name: "around the equals sign",
+			groups: []string{
+				`serde = { version = "1", features = ["derive"] }`,
+				"serde\t=\t{ version\t=\t\"1\",\tfeatures = [\"derive\"] }",
+				"serde\t\t= {version=\"1\",features=[\"derive\"]}",
+			},
+		},
+		{
+			name: "multi-line values",
+			groups: []string{
+				"tokio = { version = \"1\", features = [\n    \"macros\",\n    \"rt\",\n] }",
+				"tokio\t=\t{ version = \"1\", features = [\n\t\"macros\",\n\t\"rt\",\n] }",
+			},
+		},
+		{
+			name: "subtables",
+			groups: []string{
+				"[dependencies.tokio]\nversion = \"1\"\ndefault-features = false",
+				"[dependencies.tokio]\n\tversion\t= \"1\"\n\tdefault-features\t=\tfalse",
+			},
+		},
+	} {
+		want := CanonicalText(tt.groups[0])
+		for _, group := range tt.groups[1:] {
+			if got := CanonicalText(group); got != want {
+				t.Errorf("%s: CanonicalText(%q) = %q, want %q", tt.name, group, got, want)
+			}
+			if ComputeContentHash(group) != ComputeContentHash(tt.groups[0]) {
+				t.Errorf("%s: %q hashes differently from %q", tt.name, group, tt.groups[0])
+			}
+		}
+	}
+}
+
+func TestCanonicalTextKeepsTabsInStrings(t *testing.T) {
+	if CanonicalText("x = { git = \"a\tb\" }") == CanonicalText("x = { git = \"a b\" }") {
+		t.Error("a tab inside a string was collapsed")
+	}
+}
+
+func TestSubtableMatchesInlineForm(t *testing.T) {
+	for _, tt := range []struct {
+		inline   string
+		subtable string
+	}{
+		{
+			inline:   `tokio = { version = "1", default-features = false, features = ["macros", "rt"] }`,
+			subtable: "[dependencies.tokio]\nversion = \"1\"\ndefault-features = false\nfeatures = [\"macros\", \"rt\"]",
+		},
+		{
+			inline:   `foo = { git = "https://github.com/acme/foo", branch = "main", optional = true }`,
+			subtable: "[dependencies.foo]\n# pinned until the fork is merged\ngit = 'https://github.com/acme/foo'\noptional = true\nbranch = \"main\"",
+		},
+		{
+			inline:   `bar = { package = "bar-rs", path = "../bar" }`,
+			subtable: "[target.'cfg(unix)'.dependencies.bar]\npath = \"../bar\"\npackage = \"bar-rs\"",
+		},
+		{
+			inline:   `baz = { workspace = true, features = ["std"] }`,
+			subtable: "[workspace.dependencies.baz]\nworkspace = true\nfeatures = [\n    \"std\",\n]",
+		},
+	} {
+		inline, err := ParseDependencyLine(tt.inline)
+		if err != nil {
+			t.Errorf("ParseDependencyLine(%q): %v", tt.inline, err)
+			continue
+		}
+		entries := SplitEntries(tt.subtable)
+		if len(entries) != 1 {
+			t.Errorf("SplitEntries(%q) = %d entries, want 1", tt.subtable, len(entries))
+			continue
+		}
+		subtable, err := entries[0].Dependency()
+		if err != nil {
+			t.Errorf("Dependency of %q: %v", tt.subtable, err)
+			continue
+		}
+		subtable.Comments = nil
+		if !reflect.DeepEqual(subtable, inline) {
+			t.Errorf("subtable %q = %+v, inline %q = %+v", tt.subtable, subtable, tt.inline, inline)
+		}
+
+		direct, err := ParseDependencySubtable(tt.subtable)
+		if err != nil {
+			t.Errorf("ParseDependencySubtable(%q): %v", tt.subtable, err)
+		} else if !reflect.DeepEqual(direct, inline) {
+			t.Errorf("ParseDependencySubtable(%q) = %+v, want %+v", tt.subtable, direct, inline)
+		}
+	}
+}
+
+func TestSubtableHashesLikeInlineForm(t *testing.T) {
+	inline := `tokio = { version = "1", default-features = false, features = ["macros"] }`
+	for _, subtable := range []string{
+		"[dependencies.tokio]\nversion = \"1\"\ndefault-features = false\nfeatures = [\"macros\"]",
+		"[dependencies.tokio]\nfeatures = [\n    \"macros\",\n]\ndefault-features = false\nversion = '1'",
+	} {
+		if got, want := CanonicalText(subtable), CanonicalText(inline); got != want {
+			t.Errorf("CanonicalText(%q) = %q, want %q", subtable, got, want)
+		}
+		if ComputeContentHash(subtable) != ComputeContentHash(inline) {
+			t.Errorf("%q hashes differently from %q", subtable, inline)
+		}
+	}
+}
+
+func TestDottedKeyLinesAreOneEntry(t *testing.T) {
+	for _, tt := range []struct {
+		group string
+		want  []Dependency
+	}{
+		{
+			group: "serde.version = \"1\"\nserde.features = [\"derive\"]",
+			want:  []Dependency{{Name: "serde", Version: "1", Features: []string{"derive"}, DefaultFeatures: true}},
+		},
+		{
+			group: "tokio.workspace = true\n# every runtime feature\ntokio.features = [\"full\"]\nrand = \"0.8\"",
+			want: []Dependency{
+				{Name: "tokio", Workspace: true, Features: []string{"full"}, DefaultFeatures: true},
+				{Name: "rand", Version: "0.8", DefaultFeatures: true},
+			},
+		},
+		{
+			group: "serde.version = \"1\"\nrand.version = \"0.8\"\nserde.optional = true",
+			want: []Dependency{
+				{Name: "serde", Version: "1", DefaultFeatures: true},
+				{Name: "rand", Version: "0.8", DefaultFeatures: true},
+				{Name: "serde", Optional: true, DefaultFeatures: true},
+			},
+		},
+		{
+			// Repeated plain declarations stay apart so they can be reported
+			group: "serde = \"1\"\nserde = \"2\"",
+			want: []Dependency{
+				{Name: "serde", Version: "1", DefaultFeatures: true},
+				{Name: "serde", Version: "2", DefaultFeatures: true},
+			},
+		},
+	} {
+		entries := SplitEntries(tt.group)
+		var got []Dependency
+		for _, entry := range entries {
+			dep, err := entry.Dependency()
+			if err != nil {
+				t.Errorf("%q: entry %q: %v", tt.group, entry.Lines, err)
+			}
+			if entry.Name != dep.Name {
+				t.Errorf("%q: entry named %s parsed as %s", tt.group, entry.Name, dep.Name)
+			}
+			got = append(got, dep)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q:\ngot  %+v\nwant %+v", tt.group, got, tt.want)
+		}
+	}
+}
+
+func TestDottedKeyEntryKeepsRawLines(t *testing.T) {
+	group := "tokio.workspace = true\n  tokio.features = [\n    \"full\",\n  ]"
+	entries := SplitEntries(group)
+	if len(entries) != 1 {
+		t.Fatalf("%d entries, want 1", len(entries))
+	}
+	if got := lines(entries[0].Raw...); got != group {
+		t.Errorf("raw = %q, want %q", got, group)
+	}
+}
+
+func TestDottedKeysHashLikeInlineForm(t *testing.T) {
+	for _, tt := range []struct {
+		dotted string
+		inline string
+	}{
+		{"serde.version = \"1\"\nserde.features = [\"derive\"]", `serde = { version = "1", features = ["derive"] }`},
+		{"tokio.workspace = true\ntokio.features = [\"full\"]", `tokio = { workspace = true, features = ["full"] }`},
+		{`rand.version = "0.8"`, `rand = { version = "0.8" }`},
+		{`x = { a.b = "c" }`, `x = { a = { b = "c" } }`},
+		{"[dependencies.x]\na.b = \"c\"", `x = { a.b = "c" }`},
+		{`s = { git = "https://example.com/café" }`, `s = { git = 'https://example.com/café' }`},
+	} {
+		if got, want := CanonicalText(tt.dotted), CanonicalText(tt.inline); got != want {
+			t.Errorf("CanonicalText(%q) = %q, want %q", tt.dotted, got, want)
+		}
+	}
+}
+
+func TestMultilineStringValues(t *testing.T) {
+	entries := SplitEntries("foo = { git = '''https://example.com/foo''', branch = \"\"\"main\"\"\" }")
+	dep, err := entries[0].Dependency()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dep.Git != "https://example.com/foo" || dep.Branch != "main" {
+		t.Errorf("dependency = %+v", dep)
+	}
+}
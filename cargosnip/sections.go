@@ -0,0 +1,337 @@
+// Package cargosnip extracts the dependency sections of Cargo.toml
+// manifests, splits them into the blank-line separated groups that
+// download_cargo_deps saves as snippets, and computes the content hashes
+// those snippets are deduplicated by.
+//
+// The functions here only parse and return values; fetching manifests,
+// logging and writing snippet files are left to the caller.
+package cargosnip
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// StripBOM drops a leading UTF-8 byte order mark, which would otherwise keep
+// the first table header from being recognized.
+func StripBOM(content string) string {
+	return strings.TrimPrefix(content, "\ufeff")
+}
+
+// NormalizeLineEndings converts CRLF and lone CR line endings to LF so that
+// snippets from Windows-edited manifests hash identically to LF ones.
+func NormalizeLineEndings(content string) string {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	return strings.ReplaceAll(content, "\r", "\n")
+}
+
+// keyValuePattern matches the start of a key/value line.
+var keyValuePattern = regexp.MustCompile(`^[A-Za-z0-9_.\-"' \t]+=`)
+
+// SkipLeadingJunk drops non-TOML lines (e.g. templating artifacts such as
+// "+++") that appear before the first table header and returns the rest of
+// content along with how many lines it dropped. Blank lines, comments and
+// key/value pairs are treated as valid TOML. Content without a table header
+// is returned unchanged.
+func SkipLeadingJunk(content string) (string, int) {
+	lines := strings.Split(content, "\n")
+
+	junk := 0
+	for i, line := range lines {
+		stripped := strings.TrimSpace(line)
+		if _, ok := ParseTableHeader(stripped); ok {
+			if junk == 0 {
+				return content, 0
+			}
+			return strings.Join(lines[i:], "\n"), junk
+		}
+		if stripped == "" || strings.HasPrefix(stripped, "#") || keyValuePattern.MatchString(stripped) {
+			continue
+		}
+		junk++
+	}
+
+	return content, 0
+}
+
+// dependencySectionNames maps the dotted header paths of the extracted
+// sections to the names they are saved under.
+var dependencySectionNames = map[string]string{
+	"dependencies":           "dependencies",
+	"dev-dependencies":       "dev-dependencies",
+	"build-dependencies":     "build-dependencies",
+	"workspace.dependencies": "workspace.dependencies",
+	FeaturesSection:          FeaturesSection,
+	ReplaceSection:           ReplaceSection,
+}
+
+// FeaturesSection is the [features] table. It is extracted with the
+// dependency sections because feature definitions reference optional
+// dependencies, but its entries are not dependencies themselves.
+const FeaturesSection = "features"
+
+// ReplaceSection and the [patch.<registry>] tables override where crates
+// come from. They are extracted so builds relying on forks can be
+// reproduced, but their entries are overrides, not dependencies of the
+// repository.
+const ReplaceSection = "replace"
+
+// DeclaresDependencies reports whether the entries of sectionName are
+// dependencies of the repository, as opposed to feature definitions or
+// overrides.
+func DeclaresDependencies(sectionName string) bool {
+	return sectionName != FeaturesSection && sectionName != ReplaceSection &&
+		!strings.HasPrefix(sectionName, "patch.")
+}
+
+// targetDependencyKinds are the dependency tables that may appear under a
+// [target.<triple or cfg>] table.
+var targetDependencyKinds = map[string]bool{
+	"dependencies":       true,
+	"dev-dependencies":   true,
+	"build-dependencies": true,
+}
+
+// dependencySectionName returns the section name for header, or "" when the
+// header does not start a dependency section.
+// Target-specific tables keep their triple or cfg, e.g.
+// target.cfg(windows).dependencies, and patch tables their registry, e.g.
+// patch.crates-io.
+func dependencySectionName(header TableHeader) string {
+	if header.IsArray {
+		return ""
+	}
+	var name string
+	switch {
+	case len(header.Keys) == 3 && header.Keys[0] == "target" && targetDependencyKinds[header.Keys[2]]:
+		name = header.Name()
+	case len(header.Keys) == 2 && header.Keys[0] == "patch":
+		name = header.Name()
+	default:
+		name = dependencySectionNames[strings.ToLower(header.Name())]
+	}
+	return name
+}
+
+// SectionKinds are the kinds of dependency section, in the order
+// download_cargo_deps lists them for -sections. "target" covers every
+// target-specific table and "patch" every [patch.<registry>] table.
+var SectionKinds = []string{
+	"dependencies", "dev-dependencies", "build-dependencies", "workspace.dependencies",
+	"target", FeaturesSection, "patch", ReplaceSection,
+}
+
+// SectionKind returns the entry of SectionKinds that sectionName belongs to.
+func SectionKind(sectionName string) string {
+	kind, _, _ := strings.Cut(sectionName, ".")
+	if kind == "target" || kind == "patch" {
+		return kind
+	}
+	return sectionName
+}
+
+// dependencySubtableParent returns the dependency section that a per-crate
+// subtable such as [dependencies.serde], [workspace.dependencies.tokio] or
+// [target.'cfg(unix)'.dev-dependencies.libc] belongs to, along with the
+// parent header's keys. It returns "" otherwise.
+func dependencySubtableParent(header TableHeader) (string, []string) {
+	if header.IsArray || len(header.Keys) < 2 {
+		return "", nil
+	}
+	parentKeys := header.Keys[:len(header.Keys)-1]
+	parent := dependencySectionName(TableHeader{Keys: parentKeys})
+	if parent == "" {
+		return "", nil
+	}
+	return parent, parentKeys
+}
+
+// sectionBuffer accumulates the lines of one dependency section. Subtable
+// lines are kept apart so they can be emitted after the plain entries, which
+// keeps the reassembled section valid TOML.
+type sectionBuffer struct {
+	lines       []string // header followed by the section's own entries
+	subtables   []string // folded [<section>.<crate>] subtables
+	synthesized bool     // lines[0] is a generated header, not from the source
+}
+
+// ExtractDependencySections returns the text of each dependency section in
+// content, keyed by section name. See ReadDependencySections.
+func ExtractDependencySections(content string) map[string]string {
+	sections, _ := ReadDependencySections(strings.NewReader(content))
+	return sections
+}
+
+// ReadDependencySections reads a Cargo.toml from r line by line and returns
+// the text of each dependency section, keyed by section name. Per-crate
+// subtables like [dependencies.serde] are folded into their parent section
+// after its plain entries; if the parent header itself is absent, one is
+// synthesized.
+//
+// Lines outside dependency sections are dropped as they are read, so memory
+// grows with the dependency sections rather than the whole file. Sections
+// are only complete at the end of the input, since a subtable further down
+// can still fold into any of them.
+func ReadDependencySections(r io.Reader) (map[string]string, error) {
+	extractor := sectionExtractor{buffers: make(map[string]*sectionBuffer)}
+	reader := bufio.NewReader(r)
+	for {
+		// ReadString rather than a bufio.Scanner: the empty line after a
+		// final newline is kept, and long lines need no buffer limit
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		extractor.addLine(strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"))
+		if err == io.EOF {
+			break
+		}
+	}
+
+	sections := make(map[string]string, len(extractor.buffers))
+	for name, buf := range extractor.buffers {
+		sections[name] = strings.Join(append(buf.lines, buf.subtables...), "\n")
+	}
+	return sections, nil
+}
+
+// DependencySectionOrder returns the names of the dependency sections of
+// content in the order they first appear, counting a folded subtable as an
+// appearance of its parent.
+func DependencySectionOrder(content string) []string {
+	extractor := sectionExtractor{buffers: make(map[string]*sectionBuffer)}
+	for _, line := range strings.Split(content, "\n") {
+		extractor.addLine(line)
+	}
+	return extractor.order
+}
+
+// sectionExtractor collects dependency sections one line at a time.
+type sectionExtractor struct {
+	buffers map[string]*sectionBuffer
+	order   []string  // section names in order of first appearance
+	target  *[]string // lines of the section or subtable being read, if any
+	scanner LineScanner
+}
+
+// addLine adds the next line of the manifest: to the section or subtable
+// being read, or as the header that starts a new one.
+func (x *sectionExtractor) addLine(line string) {
+	header, isHeader := TableHeader{}, false
+	if x.scanner.AtTopLevel() {
+		header, isHeader = ParseTableHeader(line)
+	}
+	if !isHeader {
+		x.scanner.Scan(line)
+		if x.target != nil {
+			*x.target = append(*x.target, line)
+		}
+		return
+	}
+
+	// Any other header ends the current section
+	x.target = nil
+	if name := dependencySectionName(header); name != "" {
+		buf := x.buffers[name]
+		switch {
+		case buf == nil:
+			buf = &sectionBuffer{lines: []string{line}}
+			x.buffers[name] = buf
+			x.order = append(x.order, name)
+		case buf.synthesized:
+			buf.lines[0] = line
+			buf.synthesized = false
+		}
+		x.target = &buf.lines
+		return
+	}
+
+	if parent, parentKeys := dependencySubtableParent(header); parent != "" {
+		buf := x.buffers[parent]
+		if buf == nil {
+			buf = &sectionBuffer{lines: []string{formatTableHeader(parentKeys)}, synthesized: true}
+			x.buffers[parent] = buf
+			x.order = append(x.order, parent)
+		}
+		buf.subtables = append(buf.subtables, line)
+		x.target = &buf.subtables
+	}
+}
+
+// isPlainTableHeader reports whether line is a [table] header, as opposed
+// to an [[array-of-tables]] header or a value that merely starts with '['.
+func isPlainTableHeader(line string) bool {
+	header, ok := ParseTableHeader(line)
+	return ok && !header.IsArray
+}
+
+// SplitByBlankLines splits the text of a dependency section, as returned by
+// ExtractDependencySections, into its blank-line separated groups. The
+// section header is skipped, blank lines inside multi-line values do not
+// split, each folded [<section>.<crate>] subtable starts a group of its own,
+// and groups without a key/value line are dropped.
+func SplitByBlankLines(content string) []string {
+	lines := strings.Split(content, "\n")
+	var groups []string
+	var currentGroup []string
+	inMultiline := false
+	var scanner LineScanner
+
+	// Skip the section header line (e.g., [dependencies]). Only plain table
+	// headers qualify: an [[array-of-tables]] header never starts a
+	// dependency section.
+	startIdx := 0
+	for i, line := range lines {
+		if isPlainTableHeader(line) {
+			startIdx = i + 1
+			break
+		}
+	}
+
+	// flushGroup keeps the current group unless it is comment-only or malformed
+	flushGroup := func() {
+		hasDeps := false
+		for _, l := range currentGroup {
+			trimmed := strings.TrimSpace(l)
+			if trimmed != "" && !strings.HasPrefix(trimmed, "#") && strings.Contains(l, "=") {
+				hasDeps = true
+				break
+			}
+		}
+		if hasDeps {
+			groups = append(groups, strings.Join(currentGroup, "\n"))
+		}
+		currentGroup = nil
+	}
+
+	for _, line := range lines[startIdx:] {
+		stripped := strings.TrimSpace(line)
+
+		// A folded [<section>.<crate>] subtable header starts its own group
+		if !inMultiline && len(currentGroup) > 0 && isPlainTableHeader(stripped) {
+			flushGroup()
+		}
+
+		// Track multiline entries; brackets in strings and comments don't count
+		scanner.Scan(line)
+		inMultiline = !scanner.AtTopLevel()
+
+		// Check for blank line
+		if stripped == "" && !inMultiline {
+			if len(currentGroup) > 0 {
+				flushGroup()
+			}
+		} else {
+			currentGroup = append(currentGroup, line)
+		}
+	}
+
+	// Don't forget the last group
+	if len(currentGroup) > 0 {
+		flushGroup()
+	}
+
+	return groups
+}
@@ -0,0 +1,382 @@
+package cargosnip
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// lines joins its arguments with newlines.
+func lines(l ...string) string {
+	return strings.Join(l, "\n")
+}
+
+func TestSplitByBlankLines(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		section string
+		want    []string
+	}{
+		{
+			name: "blank lines separate groups",
+			section: lines(
+				"[dependencies]",
+				`serde = "1"`,
+				`serde_json = "1"`,
+				"",
+				"",
+				`tokio = "1"`,
+				""),
+			want: []string{
+				lines(`serde = "1"`, `serde_json = "1"`),
+				`tokio = "1"`,
+			},
+		},
+		{
+			name: "multi-line inline table",
+			section: lines(
+				"[dependencies]",
+				"serde = {",
+				`    version = "1",`,
+				"",
+				`    features = ["derive"],`,
+				"}",
+				`anyhow = "1"`,
+				"",
+				`tokio = "1"`),
+			want: []string{
+				lines("serde = {", `    version = "1",`, "", `    features = ["derive"],`, "}", `anyhow = "1"`),
+				`tokio = "1"`,
+			},
+		},
+		{
+			name: "multi-line features array",
+			section: lines(
+				"[dependencies]",
+				`tokio = { version = "1", features = [`,
+				`    "macros",`,
+				"",
+				`    "rt-multi-thread",`,
+				"] }",
+				"",
+				`bytes = "1"`),
+			want: []string{
+				lines(`tokio = { version = "1", features = [`, `    "macros",`, "", `    "rt-multi-thread",`, "] }"),
+				`bytes = "1"`,
+			},
+		},
+		{
+			name: "brackets in comments",
+			section: lines(
+				"[dependencies]",
+				`rand = "0.8" # see [features] below`,
+				"# ] stray bracket",
+				"",
+				"# [not a header",
+				`log = "0.4"`,
+				"",
+				`features = [ # the [default] set`,
+				`    "std",`,
+				"",
+				"]"),
+			want: []string{
+				lines(`rand = "0.8" # see [features] below`, "# ] stray bracket"),
+				lines("# [not a header", `log = "0.4"`),
+				lines(`features = [ # the [default] set`, `    "std",`, "", "]"),
+			},
+		},
+		{
+			name: "brackets in strings",
+			section: lines(
+				"[dependencies]",
+				`weird = { git = "https://example.com/[x", branch = "{" }`,
+				"",
+				`other = "1"`),
+			want: []string{
+				`weird = { git = "https://example.com/[x", branch = "{" }`,
+				`other = "1"`,
+			},
+		},
+		{
+			name: "comment-only groups are dropped",
+			section: lines(
+				"[dependencies]",
+				"# Core",
+				"",
+				`serde = "1"`,
+				"",
+				"# old = \"1\""),
+			want: []string{`serde = "1"`},
+		},
+		{
+			name: "folded subtables start their own group",
+			section: lines(
+				"[dependencies]",
+				`serde = "1"`,
+				"[dependencies.tokio]",
+				`version = "1"`,
+				"[dependencies.rand]",
+				`version = "0.8"`),
+			want: []string{
+				`serde = "1"`,
+				lines("[dependencies.tokio]", `version = "1"`),
+				lines("[dependencies.rand]", `version = "0.8"`),
+			},
+		},
+	} {
+		if got := SplitByBlankLines(tt.section); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s:\ngot  %q\nwant %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLineEndingsHashTheSame(t *testing.T) {
+	lf := lines("[dependencies]", `serde = "1"`, "", "tokio = {", `  version = "1",`, "}", "")
+	for _, content := range []string{
+		strings.ReplaceAll(lf, "\n", "\r\n"),
+		strings.ReplaceAll(lf, "\n", "\r"),
+	} {
+		normalized := NormalizeLineEndings(content)
+		if normalized != lf {
+			t.Errorf("NormalizeLineEndings(%q) = %q, want %q", content, normalized, lf)
+		}
+		got := SplitByBlankLines(ExtractDependencySections(normalized)["dependencies"])
+		want := SplitByBlankLines(ExtractDependencySections(lf)["dependencies"])
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("groups of %q = %q, want %q", content, got, want)
+			continue
+		}
+		for i := range want {
+			if ComputeContentHash(got[i]) != ComputeContentHash(want[i]) {
+				t.Errorf("group %q hashes differently from %q", got[i], want[i])
+			}
+		}
+	}
+}
+
+func TestBOMDoesNotHideFirstSection(t *testing.T) {
+	plain := lines("[dependencies]", `serde = "1"`, "", "[features]", `default = []`, "")
+	content := StripBOM("\ufeff" + plain)
+	if content != plain {
+		t.Fatalf("StripBOM left %q", content)
+	}
+
+	sections := ExtractDependencySections(content)
+	if sections["dependencies"] != ExtractDependencySections(plain)["dependencies"] {
+		t.Errorf("dependencies = %q, want %q", sections["dependencies"], ExtractDependencySections(plain)["dependencies"])
+	}
+	if got, want := DependencySectionOrder(content), []string{"dependencies", "features"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("DependencySectionOrder = %q, want %q", got, want)
+	}
+	// Without StripBOM the first header is not recognized
+	if _, ok := ExtractDependencySections("\ufeff" + plain)["dependencies"]; ok {
+		t.Error("a BOM-prefixed [dependencies] header was recognized without StripBOM")
+	}
+}
+
+func TestSkipLeadingJunk(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		content string
+		want    string
+		skipped int
+	}{
+		{
+			name:    "clean manifest",
+			content: lines("[package]", `name = "x"`),
+			want:    lines("[package]", `name = "x"`),
+		},
+		{
+			name:    "front matter",
+			content: lines("+++", `title = "x"`, "+++", "", "[dependencies]", `serde = "1"`),
+			want:    lines("[dependencies]", `serde = "1"`),
+			skipped: 2,
+		},
+		{
+			name:    "tab-indented key/value lines are TOML",
+			content: lines("\tname\t=\t\"x\"", "\t# comment", "[dependencies]"),
+			want:    lines("\tname\t=\t\"x\"", "\t# comment", "[dependencies]"),
+		},
+		{
+			name:    "tab-separated key/value lines are TOML",
+			content: lines("{{ template }}", "key\t=\tvalue", "\t[dependencies]", "\tserde\t=\t\"1\""),
+			want:    lines("\t[dependencies]", "\tserde\t=\t\"1\""),
+			skipped: 1,
+		},
+		{
+			name:    "no table header",
+			content: lines("+++", `serde = "1"`),
+			want:    lines("+++", `serde = "1"`),
+		},
+	} {
+		got, skipped := SkipLeadingJunk(tt.content)
+		if got != tt.want || skipped != tt.skipped {
+			t.Errorf("%s: SkipLeadingJunk = %q, %d; want %q, %d", tt.name, got, skipped, tt.want, tt.skipped)
+		}
+	}
+}
+
+func TestTabIndentedSectionsSplit(t *testing.T) {
+	content := lines("[dependencies]", "\tserde\t=\t\"1\"", "\t", "\ttokio\t=\t{ version = \"1\" }", "", "[dev-dependencies]", "\trand = \"0.8\"")
+	sections := ExtractDependencySections(content)
+	groups := SplitByBlankLines(sections["dependencies"])
+	if want := []string{"\tserde\t=\t\"1\"", "\ttokio\t=\t{ version = \"1\" }"}; !reflect.DeepEqual(groups, want) {
+		t.Errorf("groups = %q, want %q", groups, want)
+	}
+	if _, ok := sections["dev-dependencies"]; !ok {
+		t.Error("[dev-dependencies] after tab-indented entries was not extracted")
+	}
+}
+
+func TestWorkspaceDependencySubtablesFold(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		content string
+		want    map[string]string
+		order   []string
+	}{
+		{
+			name: "after the parent table",
+			content: lines(
+				"[workspace]",
+				`members = ["a"]`,
+				"",
+				"[workspace.dependencies]",
+				`serde = "1"`,
+				"",
+				"[workspace.dependencies.tokio]",
+				`version = "1"`,
+				`features = ["full"]`,
+				"",
+				"[profile.release]",
+				"lto = true"),
+			want: map[string]string{
+				"workspace.dependencies": lines(
+					"[workspace.dependencies]", `serde = "1"`, "",
+					"[workspace.dependencies.tokio]", `version = "1"`, `features = ["full"]`, ""),
+			},
+			order: []string{"workspace.dependencies"},
+		},
+		{
+			name: "before the parent table",
+			content: lines(
+				"[workspace.dependencies.tokio]",
+				`version = "1"`,
+				"[workspace.dependencies]",
+				`serde = "1"`),
+			want: map[string]string{
+				"workspace.dependencies": lines(
+					"[workspace.dependencies]", `serde = "1"`,
+					"[workspace.dependencies.tokio]", `version = "1"`),
+			},
+			order: []string{"workspace.dependencies"},
+		},
+		{
+			name: "without the parent table",
+			content: lines(
+				"[workspace]",
+				`members = ["a"]`,
+				"",
+				`[workspace.dependencies."quoted-crate"]`,
+				`version = "2"`),
+			want: map[string]string{
+				"workspace.dependencies": lines(
+					"[workspace.dependencies]",
+					`[workspace.dependencies."quoted-crate"]`, `version = "2"`),
+			},
+			order: []string{"workspace.dependencies"},
+		},
+		{
+			name: "alongside member dependencies",
+			content: lines(
+				"[dependencies.rand]",
+				`workspace = true`,
+				"[workspace.dependencies.rand]",
+				`version = "0.8"`),
+			want: map[string]string{
+				"dependencies":           lines("[dependencies]", "[dependencies.rand]", `workspace = true`),
+				"workspace.dependencies": lines("[workspace.dependencies]", "[workspace.dependencies.rand]", `version = "0.8"`),
+			},
+			order: []string{"dependencies", "workspace.dependencies"},
+		},
+	} {
+		if got := ExtractDependencySections(tt.content); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: sections = %q, want %q", tt.name, got, tt.want)
+		}
+		if got := DependencySectionOrder(tt.content); !reflect.DeepEqual(got, tt.order) {
+			t.Errorf("%s: order = %q, want %q", tt.name, got, tt.order)
+		}
+	}
+}
+
+func TestArrayOfTablesEndsSections(t *testing.T) {
+	content := lines(
+		"[package]",
+		`name = "x"`,
+		"",
+		"[dependencies]",
+		`serde = "1"`,
+		"[[bin]]",
+		`name = "x-cli"`,
+		`path = "src/cli.rs"`,
+		"",
+		"[dev-dependencies]",
+		`rand = "0.8"`,
+		"",
+		"[[bench]]",
+		`name = "speed"`,
+		"",
+		"[target.'cfg(test)']",
+		`rustflags = ["-Dwarnings"]`,
+		"",
+		"[target.'cfg(unix)'.dependencies]",
+		`libc = "0.2"`,
+		"[[example]]",
+		`name = "demo"`,
+		"[build-dependencies]",
+		`cc = "1"`)
+	want := map[string]string{
+		"dependencies":                  lines("[dependencies]", `serde = "1"`),
+		"dev-dependencies":              lines("[dev-dependencies]", `rand = "0.8"`, ""),
+		"target.cfg(unix).dependencies": lines("[target.'cfg(unix)'.dependencies]", `libc = "0.2"`),
+		"build-dependencies":            lines("[build-dependencies]", `cc = "1"`),
+	}
+	if got := ExtractDependencySections(content); !reflect.DeepEqual(got, want) {
+		t.Errorf("sections = %q, want %q", got, want)
+	}
+}
+
+func TestSplitByBlankLinesSkipsOnlyPlainHeaders(t *testing.T) {
+	// A section text whose first bracketed line is an array-of-tables
+	// header has no section header to skip; the first plain one is
+	groups := SplitByBlankLines(lines("[[bin]]", `name = "x"`, "[dependencies]", `serde = "1"`))
+	if want := []string{`serde = "1"`}; !reflect.DeepEqual(groups, want) {
+		t.Errorf("groups = %q, want %q", groups, want)
+	}
+}
+
+func TestJunkBeforePackageIsSkipped(t *testing.T) {
+	content := lines(
+		"---",
+		"layout: manifest",
+		"---",
+		"{% if workspace %}",
+		"",
+		"[package]",
+		`name = "templated"`,
+		"",
+		"[dependencies]",
+		`serde = "1"`,
+		"")
+	rest, skipped := SkipLeadingJunk(content)
+	if skipped != 4 {
+		t.Errorf("skipped %d lines, want 4", skipped)
+	}
+	if !strings.HasPrefix(rest, "[package]\n") {
+		t.Errorf("content after the junk = %q, want it to start at [package]", rest)
+	}
+	sections := ExtractDependencySections(rest)
+	if want := lines("[dependencies]", `serde = "1"`, ""); sections["dependencies"] != want {
+		t.Errorf("dependencies = %q, want %q", sections["dependencies"], want)
+	}
+}
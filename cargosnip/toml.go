@@ -0,0 +1,349 @@
+package cargosnip
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// This file slices manifests into table headers and key/value pairs line by
+// line, so that snippets keep their original text. Values themselves are
+// decoded by go-toml.
+
+// TableHeader is a parsed TOML table header such as [dependencies] or
+// [[bin]].
+type TableHeader struct {
+	Keys    []string // dotted key path with quotes removed
+	IsArray bool     // true for [[array-of-tables]] headers
+}
+
+// Name returns the header's key path joined with dots.
+func (h TableHeader) Name() string {
+	return strings.Join(h.Keys, ".")
+}
+
+// ParseTableHeader parses line as a TOML table header. Quoted keys, spaces
+// around dots and trailing comments are handled; ok is false for anything
+// that is not a well-formed header.
+func ParseTableHeader(line string) (header TableHeader, ok bool) {
+	rest := strings.TrimSpace(line)
+	if !strings.HasPrefix(rest, "[") {
+		return TableHeader{}, false
+	}
+	if strings.HasPrefix(rest, "[[") {
+		header.IsArray = true
+		rest = rest[2:]
+	} else {
+		rest = rest[1:]
+	}
+
+	for {
+		rest = strings.TrimLeft(rest, " \t")
+		key, remainder, ok := parseKey(rest)
+		if !ok {
+			return TableHeader{}, false
+		}
+		header.Keys = append(header.Keys, key)
+		rest = strings.TrimLeft(remainder, " \t")
+
+		if strings.HasPrefix(rest, ".") {
+			rest = rest[1:]
+			continue
+		}
+		closing := "]"
+		if header.IsArray {
+			closing = "]]"
+		}
+		if !strings.HasPrefix(rest, closing) {
+			return TableHeader{}, false
+		}
+		rest = strings.TrimSpace(rest[len(closing):])
+		if rest != "" && !strings.HasPrefix(rest, "#") {
+			return TableHeader{}, false
+		}
+		return header, true
+	}
+}
+
+// parseKey reads one bare, basic-quoted or literal-quoted key from the
+// start of s and returns it unquoted along with the remaining input.
+func parseKey(s string) (key, rest string, ok bool) {
+	if s == "" {
+		return "", "", false
+	}
+	switch s[0] {
+	case '"':
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				key, ok := decodeBasicString(s[:i+1])
+				return key, s[i+1:], ok
+			}
+		}
+		return "", "", false
+	case '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", "", false
+		}
+		return s[1 : end+1], s[end+2:], true
+	default:
+		end := 0
+		for end < len(s) && isBareKeyChar(s[end]) {
+			end++
+		}
+		if end == 0 {
+			return "", "", false
+		}
+		return s[:end], s[end:], true
+	}
+}
+
+// decodeBasicString decodes quoted, a complete "..." string, resolving its
+// escape sequences.
+func decodeBasicString(quoted string) (string, bool) {
+	value, err := decodeValue(quoted)
+	str, ok := value.(string)
+	return str, err == nil && ok
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// LineScanner tracks, line by line, whether the input is inside a
+// multi-line string or an array/inline-table value, where a "[...]" line
+// must not be mistaken for a table header.
+type LineScanner struct {
+	multilineQuote string // `"""` or `'''` while inside a multi-line string
+	depth          int    // open [ and { brackets of the current value
+}
+
+// AtTopLevel reports whether the next line starts outside any value.
+func (sc *LineScanner) AtTopLevel() bool {
+	return sc.multilineQuote == "" && sc.depth == 0
+}
+
+// Scan consumes line, updating the string and bracket state. Brackets
+// inside strings and comments are ignored.
+func (sc *LineScanner) Scan(line string) {
+	for i := 0; i < len(line); i++ {
+		if sc.multilineQuote != "" {
+			if strings.HasPrefix(line[i:], sc.multilineQuote) {
+				i += len(sc.multilineQuote) - 1
+				sc.multilineQuote = ""
+			} else if line[i] == '\\' && sc.multilineQuote == `"""` {
+				i++
+			}
+			continue
+		}
+
+		switch c := line[i]; c {
+		case '#':
+			return
+		case '"', '\'':
+			quote := string(c)
+			if strings.HasPrefix(line[i:], quote+quote+quote) {
+				sc.multilineQuote = quote + quote + quote
+				i += 2
+				continue
+			}
+			for i++; i < len(line) && line[i] != c; i++ {
+				if c == '"' && line[i] == '\\' {
+					i++
+				}
+			}
+		case '[', '{':
+			sc.depth++
+		case ']', '}':
+			if sc.depth > 0 {
+				sc.depth--
+			}
+		}
+	}
+}
+
+// formatTableHeader renders keys as a table header, quoting keys that are
+// not valid bare keys.
+func formatTableHeader(keys []string) string {
+	quoted := make([]string, len(keys))
+	for i, key := range keys {
+		quoted[i] = formatKey(key)
+	}
+	return "[" + strings.Join(quoted, ".") + "]"
+}
+
+// formatKey renders key bare when it can be, and quoted otherwise.
+func formatKey(key string) string {
+	bare := key != ""
+	for j := 0; j < len(key); j++ {
+		if !isBareKeyChar(key[j]) {
+			bare = false
+			break
+		}
+	}
+	switch {
+	case bare:
+		return key
+	case !strings.Contains(key, "'"):
+		return "'" + key + "'"
+	default:
+		return strconv.Quote(key)
+	}
+}
+
+// ParseKeyValue parses a `key = value` pair at the start of s, where key
+// may be dotted. It returns the key parts, the value and the remaining text.
+func ParseKeyValue(s string) (keys []string, value any, rest string, err error) {
+	rest = strings.TrimSpace(s)
+	for {
+		key, after, ok := parseKey(rest)
+		if !ok {
+			return nil, nil, "", fmt.Errorf("invalid key in %q", s)
+		}
+		keys = append(keys, key)
+		rest = strings.TrimLeft(after, " \t")
+		if !strings.HasPrefix(rest, ".") {
+			break
+		}
+		rest = strings.TrimLeft(rest[1:], " \t")
+	}
+	if !strings.HasPrefix(rest, "=") {
+		return nil, nil, "", fmt.Errorf("missing '=' after key %s", strings.Join(keys, "."))
+	}
+	rest = strings.TrimLeft(rest[1:], " \t")
+	end := len(strings.TrimRight(rest[:valueEnd(rest)], " \t\r"))
+	if end == 0 {
+		return nil, nil, "", fmt.Errorf("missing value after key %s", strings.Join(keys, "."))
+	}
+	value, err = decodeValue(rest[:end])
+	return keys, value, rest[end:], err
+}
+
+// valueEnd returns the length of the value at the start of s: up to the end
+// of the line or a comment, once every string, array and inline table has
+// been closed.
+func valueEnd(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\'':
+			quote := string(c)
+			if strings.HasPrefix(s[i:], quote+quote+quote) {
+				quote += quote + quote
+			}
+			j := i + len(quote)
+			for ; j < len(s) && !strings.HasPrefix(s[j:], quote); j++ {
+				if len(quote) == 1 && s[j] == '\n' {
+					break // unterminated; left for the decoder to report
+				}
+				if c == '"' && s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) || s[j] == '\n' {
+				i = j - 1
+				continue
+			}
+			end := j + len(quote)
+			// A multi-line string may end with up to two more quotes
+			for n := 0; len(quote) == 3 && n < 2 && end < len(s) && s[end] == c; n++ {
+				end++
+			}
+			i = end - 1
+		case '[', '{':
+			depth++
+		case ']', '}':
+			depth--
+		case '#':
+			if depth <= 0 {
+				return i
+			}
+			for i+1 < len(s) && s[i+1] != '\n' {
+				i++
+			}
+		case '\n':
+			if depth <= 0 {
+				return i
+			}
+		}
+	}
+	return len(s)
+}
+
+// decodeValue decodes the TOML value text, such as "1.0", ["derive"] or a
+// possibly multi-line inline table. Arrays are []any, tables map[string]any
+// with dotted keys nested, and integers and floats int64 and float64.
+func decodeValue(text string) (any, error) {
+	var doc map[string]any
+	if err := toml.Unmarshal([]byte("v = "+text), &doc); err != nil {
+		return nil, fmt.Errorf("invalid value %s: %w", text, err)
+	}
+	return doc["v"], nil
+}
+
+// SkipSpace drops leading whitespace, newlines and comments.
+func SkipSpace(s string) string {
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if !strings.HasPrefix(s, "#") {
+			return s
+		}
+		end := strings.IndexByte(s, '\n')
+		if end < 0 {
+			return ""
+		}
+		s = s[end:]
+	}
+}
+
+// parseTable decodes the key/value lines of a table body into the map an
+// equivalent inline table decodes to.
+func parseTable(body string) (map[string]any, error) {
+	table := make(map[string]any)
+	if err := toml.Unmarshal([]byte(body), &table); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// formatValue renders a value returned by decodeValue with canonical
+// spacing: strings double-quoted, and inline table keys sorted.
+func formatValue(value any) string {
+	switch v := value.(type) {
+	case string:
+		return strconv.Quote(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = formatValue(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fields := make([]string, len(keys))
+		for i, key := range keys {
+			fields[i] = formatKey(key) + " = " + formatValue(v[key])
+		}
+		return "{ " + strings.Join(fields, ", ") + " }"
+	}
+	return fmt.Sprint(value)
+}
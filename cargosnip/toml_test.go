@@ -0,0 +1,219 @@
+package cargosnip
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTableHeader(t *testing.T) {
+	for _, tt := range []struct {
+		line    string
+		keys    []string
+		isArray bool
+		ok      bool
+	}{
+		{"[dependencies]", []string{"dependencies"}, false, true},
+		{"  [dev-dependencies]  ", []string{"dev-dependencies"}, false, true},
+		{"[workspace.dependencies]", []string{"workspace", "dependencies"}, false, true},
+		{"[ workspace . dependencies ]", []string{"workspace", "dependencies"}, false, true},
+		{"[dependencies] # runtime crates", []string{"dependencies"}, false, true},
+		{`[target."cfg(unix)".dependencies]`, []string{"target", "cfg(unix)", "dependencies"}, false, true},
+		{`[target.'cfg(target_os = "linux")'.dependencies]`, []string{"target", `cfg(target_os = "linux")`, "dependencies"}, false, true},
+		{`["a.b"]`, []string{"a.b"}, false, true},
+		{`["quote\"d"]`, []string{`quote"d`}, false, true},
+		{"[[bin]]", []string{"bin"}, true, true},
+		{"[[ bin ]] # the CLI", []string{"bin"}, true, true},
+		{"[[package.metadata.assets]]", []string{"package", "metadata", "assets"}, true, true},
+
+		{"", nil, false, false},
+		{"dependencies", nil, false, false},
+		{"[]", nil, false, false},
+		{"[dependencies", nil, false, false},
+		{"[dependencies]]", nil, false, false},
+		{"[[bin]", nil, false, false},
+		{"[dependencies] trailing", nil, false, false},
+		{"[dependencies.]", nil, false, false},
+		{"[a b]", nil, false, false},
+		{`["unterminated]`, nil, false, false},
+		{`"serde", "derive"]`, nil, false, false},
+		{`["serde", "derive"]`, nil, false, false},
+	} {
+		header, ok := ParseTableHeader(tt.line)
+		if ok != tt.ok {
+			t.Errorf("ParseTableHeader(%q) ok = %v, want %v", tt.line, ok, tt.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if !reflect.DeepEqual(header.Keys, tt.keys) || header.IsArray != tt.isArray {
+			t.Errorf("ParseTableHeader(%q) = %q (array %v), want %q (array %v)",
+				tt.line, header.Keys, header.IsArray, tt.keys, tt.isArray)
+		}
+	}
+}
+
+func TestFormatTableHeaderRoundTrips(t *testing.T) {
+	for _, keys := range [][]string{
+		{"dependencies"},
+		{"workspace", "dependencies"},
+		{"target", "cfg(unix)", "dependencies"},
+		{"target", `cfg(target_os = "linux")`, "dependencies"},
+		{"target", `it's`, "dependencies"},
+	} {
+		line := formatTableHeader(keys)
+		header, ok := ParseTableHeader(line)
+		if !ok || !reflect.DeepEqual(header.Keys, keys) {
+			t.Errorf("formatTableHeader(%q) = %s, which parses back as %q", keys, line, header.Keys)
+		}
+	}
+}
+
+func TestLineScanner(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		lines []string
+		// topLevel[i] is AtTopLevel after scanning lines[i]
+		topLevel []bool
+	}{
+		{
+			name:     "single-line values",
+			lines:    []string{`serde = "1"`, `tokio = { version = "1", features = ["full"] }`},
+			topLevel: []bool{true, true},
+		},
+		{
+			name:     "multi-line array",
+			lines:    []string{`features = [`, `  "derive",`, `]`},
+			topLevel: []bool{false, false, true},
+		},
+		{
+			name:     "multi-line inline table",
+			lines:    []string{`serde = {`, `  version = "1",`, `  features = ["derive"],`, `}`},
+			topLevel: []bool{false, false, false, true},
+		},
+		{
+			name:     "brackets in strings",
+			lines:    []string{`a = "[not an array"`, `b = '{'`, `c = "esc\"aped ["`},
+			topLevel: []bool{true, true, true},
+		},
+		{
+			name:     "comment characters in strings",
+			lines:    []string{`a = { git = "https://example.com/#[", rev = "1" }`, `b = "# not a comment ["`},
+			topLevel: []bool{true, true},
+		},
+		{
+			name:     "brackets in comments",
+			lines:    []string{`a = "1" # see [b]`, `# [dependencies`, `features = [ # the [default] set`, `]`},
+			topLevel: []bool{true, true, false, true},
+		},
+		{
+			name:     "multi-line basic string",
+			lines:    []string{`description = """`, `[not a header]`, `ends with \"""`, `here"""`},
+			topLevel: []bool{false, false, false, true},
+		},
+		{
+			name:     "multi-line literal string",
+			lines:    []string{`description = '''`, `{ [`, `'''`},
+			topLevel: []bool{false, false, true},
+		},
+	} {
+		var sc LineScanner
+		for i, line := range tt.lines {
+			sc.Scan(line)
+			if got := sc.AtTopLevel(); got != tt.topLevel[i] {
+				t.Errorf("%s: AtTopLevel after %q = %v, want %v", tt.name, line, got, tt.topLevel[i])
+			}
+		}
+	}
+}
+
+func TestParseKeyValue(t *testing.T) {
+	for _, tt := range []struct {
+		input string
+		keys  []string
+		value any
+		rest  string
+	}{
+		{`serde = "1.0"`, []string{"serde"}, "1.0", ""},
+		{`serde='1.0'`, []string{"serde"}, "1.0", ""},
+		{`"quoted key" = "1"`, []string{"quoted key"}, "1", ""},
+		{`serde.workspace = true`, []string{"serde", "workspace"}, true, ""},
+		{`serde . version = "1" # pinned`, []string{"serde", "version"}, "1", " # pinned"},
+		{`n = 42`, []string{"n"}, int64(42), ""},
+		{`f = 1.5 # ratio`, []string{"f"}, 1.5, " # ratio"},
+		{`url = "https://example.com/#frag"`, []string{"url"}, "https://example.com/#frag", ""},
+		{`esc = "a\"b"`, []string{"esc"}, `a"b`, ""},
+		{`esc = "tab\there\nnewline"`, []string{"esc"}, "tab\there\nnewline", ""},
+		{`esc = "caf\u00e9 \U0001F980"`, []string{"esc"}, "café 🦀", ""},
+		{`lit = 'C:\no\escapes'`, []string{"lit"}, `C:\no\escapes`, ""},
+		{`"caf\u00e9" = "1"`, []string{"café"}, "1", ""},
+		{"doc = \"\"\"\nfirst [line]\n# not a comment\n\"\"\" # trailing", []string{"doc"}, "first [line]\n# not a comment\n", " # trailing"},
+		{"doc = '''\nraw \\n {'''", []string{"doc"}, `raw \n {`, ""},
+		{`doc = """quoted ""end"""""`, []string{"doc"}, `quoted ""end""`, ""},
+		{"x = { path = '''a''', version = \"\"\"1\"\"\" }", []string{"x"}, map[string]any{"path": "a", "version": "1"}, ""},
+		{`features = ["derive", "rc",]`, []string{"features"}, []any{"derive", "rc"}, ""},
+		{"features = [\n  \"a\", # first\n  \"b\",\n]", []string{"features"}, []any{"a", "b"}, ""},
+		{`serde = { version = "1", default-features = false }`, []string{"serde"},
+			map[string]any{"version": "1", "default-features": false}, ""},
+		{`x = { a.b = "c", d = [] }`, []string{"x"}, map[string]any{"a": map[string]any{"b": "c"}, "d": []any{}}, ""},
+		{"x = {\n  version = \"1\",\n  features = [\"a\"],\n}\nnext = 1", []string{"x"}, map[string]any{"version": "1", "features": []any{"a"}}, "\nnext = 1"},
+	} {
+		keys, value, rest, err := ParseKeyValue(tt.input)
+		if err != nil {
+			t.Errorf("ParseKeyValue(%q): %v", tt.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(keys, tt.keys) || !reflect.DeepEqual(value, tt.value) || rest != tt.rest {
+			t.Errorf("ParseKeyValue(%q) = %q, %#v, %q; want %q, %#v, %q",
+				tt.input, keys, value, rest, tt.keys, tt.value, tt.rest)
+		}
+	}
+}
+
+func TestParseKeyValueErrors(t *testing.T) {
+	for _, input := range []string{
+		``,
+		`= "1"`,
+		`serde`,
+		`serde = `,
+		`serde = "1`,
+		`serde = { version = "1"`,
+		`serde = { version = "1" features = [] }`,
+		`features = ["a" "b"]`,
+		`'it''s' = "1"`,
+		`bad = "\q"`,
+		`doc = """never closed`,
+		`x = { a = "1", a = "2" }`,
+	} {
+		if _, _, _, err := ParseKeyValue(input); err == nil {
+			t.Errorf("ParseKeyValue(%q) succeeded, want an error", input)
+		}
+	}
+}
+
+func TestFormatValueIsCanonical(t *testing.T) {
+	for _, tt := range []struct {
+		inputs []string
+		want   string
+	}{
+		{[]string{`"1"`, `'1'`}, `"1"`},
+		{[]string{`["a","b"]`, "[ 'a' ,\n 'b', ]"}, `["a", "b"]`},
+		{[]string{`{version="1",optional=true}`, `{ optional = true, version = '1' }`},
+			`{ optional = true, version = "1" }`},
+		{[]string{`{ "weird key" = "x" }`}, `{ 'weird key' = "x" }`},
+		{[]string{`"café"`, `'café'`, `"""café"""`}, `"café"`},
+		{[]string{`1`, `+1`, `0x1`}, `1`},
+		{[]string{`{ a.b = "c" }`, `{ a = { b = "c" } }`}, `{ a = { b = "c" } }`},
+	} {
+		for _, input := range tt.inputs {
+			value, err := decodeValue(input)
+			if err != nil {
+				t.Errorf("decodeValue(%q): %v", input, err)
+				continue
+			}
+			if got := formatValue(value); got != tt.want {
+				t.Errorf("formatValue(decodeValue(%q)) = %s, want %s", input, got, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,5 @@
+module github.com/portal-co/rice-snippets
+
+go 1.21.0
+
+require github.com/pelletier/go-toml/v2 v2.4.3
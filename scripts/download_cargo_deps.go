@@ -1,564 +1,4039 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"log/slog"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	"github.com/portal-co/rice-snippets/cargosnip"
 )
 
 type RepoInfo struct {
-	Name          string `json:"name"`
-	DefaultBranch string `json:"default_branch"`
-	FullName      string `json:"full_name"`
+	Name          string    `json:"name"`
+	DefaultBranch string    `json:"default_branch"`
+	FullName      string    `json:"full_name"`
+	Archived      bool      `json:"archived"`
+	Fork          bool      `json:"fork"`
+	PushedAt      time.Time `json:"pushed_at"`
+	Language      string    `json:"language,omitempty"` // primary language, as reported by GitHub
+}
+
+// Owner returns the account that owns the repository.
+func (r RepoInfo) Owner() string {
+	owner, _, _ := strings.Cut(r.FullName, "/")
+	return owner
+}
+
+// DiscoveryFilter controls which search results discoverRustRepos keeps.
+type DiscoveryFilter struct {
+	IncludeArchived bool
+	IncludeForks    bool
+	PushedSince     time.Time // zero keeps repositories regardless of their last push
+}
+
+// SkipCounts records how many repositories discovery filtered out, by reason.
+// Stale repositories and those beyond -max-repos are kept in full so that
+// their previous results survive -incremental and -prune.
+type SkipCounts struct {
+	Archived  int
+	Forks     int
+	Stale     []RepoInfo
+	OverLimit []RepoInfo
+}
+
+// unfetched returns the repositories that exist but were not fetched this run.
+func (s SkipCounts) unfetched() []RepoInfo {
+	return append(append([]RepoInfo(nil), s.Stale...), s.OverLimit...)
 }
 
 type GitHubSearchResponse struct {
-	Items []RepoInfo `json:"items"`
+	TotalCount int        `json:"total_count"`
+	Items      []RepoInfo `json:"items"`
 }
 
+// searchResultCap is the most results the GitHub search API returns for one
+// query, however it is paginated.
+const searchResultCap = 1000
+
 type Stats struct {
-	TotalRepos        int
-	Downloaded        int
-	Failed            int
-	SectionsExtracted int
-	GroupsExtracted   int
-	UniqueHashes      int
-	ReposWithDeps     []string
+	TotalRepos         int      `json:"total_repos"`
+	Downloaded         int      `json:"downloaded"`
+	Failed             int      `json:"failed"`
+	Unchanged          int      `json:"unchanged"`
+	PathDepsSkipped    int      `json:"path_deps_skipped"`
+	SmallGroupsSkipped int      `json:"small_groups_skipped"`
+	MemberManifests    int      `json:"member_manifests"`
+	SkippedArchived    int      `json:"skipped_archived"`
+	SkippedForks       int      `json:"skipped_forks"`
+	SkippedStale       int      `json:"skipped_stale"`
+	SkippedMaxRepos    int      `json:"skipped_max_repos"`
+	IgnoredRepos       int      `json:"ignored_repos"`
+	IgnoredSections    int      `json:"ignored_sections"`
+	SectionsExtracted  int      `json:"sections_extracted"`
+	GroupsExtracted    int      `json:"groups_extracted"`
+	UniqueHashes       int      `json:"unique_hashes"`
+	NotProcessed       int      `json:"not_processed"` // left unfetched by an interrupt
+	DedupRatio         float64  `json:"dedup_ratio"`   // 1 - UniqueHashes/GroupsExtracted
+	MostSharedHash     string   `json:"most_shared_hash,omitempty"`
+	MostSharedSources  int      `json:"most_shared_sources"`
+	ReposWithDeps      []string `json:"repos_with_deps"`
+
+	// Sizes of the section and hashed snippets produced this run; sources
+	// reused by -incremental are not counted
+	SnippetFiles         int    `json:"snippet_files"`
+	SnippetBytes         int64  `json:"snippet_bytes"`
+	SnippetLines         int    `json:"snippet_lines"`
+	GroupedBytes         int64  `json:"grouped_bytes"` // every grouped snippet, as if stored without dedup
+	HashedBytes          int64  `json:"hashed_bytes"`  // the unique hashed snippets actually stored
+	LargestSnippet       string `json:"largest_snippet,omitempty"`
+	LargestSnippetSource string `json:"largest_snippet_source,omitempty"`
+	LargestSnippetBytes  int    `json:"largest_snippet_bytes,omitempty"`
+}
+
+// addSnippetSize counts the snippet file holding text, produced for source,
+// in the size stats.
+func (s *Stats) addSnippetSize(file, source, text string) {
+	s.SnippetFiles++
+	s.SnippetBytes += int64(len(text))
+	s.SnippetLines += strings.Count(text, "\n")
+	if len(text) > s.LargestSnippetBytes {
+		s.LargestSnippet, s.LargestSnippetSource, s.LargestSnippetBytes = file, source, len(text)
+	}
 }
 
 type HashRegistry map[string][]string
 
-func main() {
-	scriptDir, err := filepath.Abs(filepath.Dir(os.Args[0]))
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error getting script directory: %v\n", err)
-		os.Exit(1)
-	}
+// RunSummary is the machine-readable counterpart of the summary READMEs,
+// written to snippets/summary.json.
+type RunSummary struct {
+	Stats        Stats        `json:"stats"`
+	Duplicates   int          `json:"duplicates"`
+	HashRegistry HashRegistry `json:"hash_registry"` // short hash -> source IDs
+}
 
-	repoRoot := filepath.Dir(scriptDir)
-	outputDir := filepath.Join(repoRoot, "snippets", "cargo")
-	groupedDir := filepath.Join(repoRoot, "snippets", "cargo-grouped")
-	hashDir := filepath.Join(repoRoot, "snippets", "cargo-hashed")
-	cargoTomlsDir := filepath.Join(repoRoot, "cargo-tomls")
+// ManifestEntry describes one unique hashed snippet in manifest.json.
+type ManifestEntry struct {
+	Hash      string   `json:"hash"`
+	ShortHash string   `json:"short_hash"`
+	Path      string   `json:"path"`
+	Sections  []string `json:"sections"`
+	Sources   []string `json:"sources"`
+}
 
-	// Create output directories
-	for _, dir := range []string{outputDir, groupedDir, hashDir, cargoTomlsDir} {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			fmt.Fprintf(os.Stderr, "Error creating directory %s: %v\n", dir, err)
-			os.Exit(1)
-		}
-	}
+// Manifest is the machine-readable index written to snippets/manifest.json.
+type Manifest struct {
+	Snippets []ManifestEntry  `json:"snippets"`
+	Sources  []ManifestSource `json:"sources,omitempty"`
+}
 
-	owner := "portal-co"
+// ManifestSource records what one Cargo.toml (a repository root or a
+// workspace member) produced, so -incremental runs can reuse it when the
+// manifest is unchanged and prune its files once it disappears.
+type ManifestSource struct {
+	Source       string          `json:"source"` // see manifestResult.source
+	Repo         string          `json:"repo"`
+	Branch       string          `json:"branch,omitempty"` // branch the manifest was downloaded from; "" for -local
+	Sections     []string        `json:"sections"`
+	Files        []string        `json:"files"` // section snippets and grouped links, relative to manifest.json
+	Groups       []ManifestGroup `json:"groups"`
+	Dependencies []DependencyUse `json:"dependencies"`
 
-	// Discover Rust repositories
-	repos, err := discoverRustRepos(owner, 100)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error discovering repositories: %v\n", err)
-		os.Exit(1)
+	// Package is only filled by -package-metadata runs
+	Package *PackageMetadata `json:"package,omitempty"`
+
+	// DependencySnippets is only filled by -dep-level-dedup runs
+	DependencySnippets []ManifestDependencySnippet `json:"dependency_snippets,omitempty"`
+}
+
+// ref returns the source with the branch it came from, e.g.
+// "portal-co/amgo@main", as written in "# Source:" headers.
+func (ms *ManifestSource) ref() string {
+	if ms.Branch == "" {
+		return ms.Source
 	}
+	return ms.Source + "@" + ms.Branch
+}
 
-	if len(repos) == 0 {
-		fmt.Println("ERROR: No repositories found. Exiting.")
-		os.Exit(1)
+// PackageMetadata is the [package] information of a manifest. Fields the
+// manifest does not set are left empty and omitted from manifest.json.
+type PackageMetadata struct {
+	Name        string `json:"name,omitempty"`
+	Version     string `json:"version,omitempty"`
+	Edition     string `json:"edition,omitempty"`
+	RustVersion string `json:"rust_version,omitempty"`
+}
+
+// ManifestGroup is one grouped snippet of a ManifestSource.
+type ManifestGroup struct {
+	Section   string `json:"section"`
+	Index     int    `json:"index"`
+	ShortHash string `json:"short_hash"`
+}
+
+// ManifestDependencySnippet is one dependency entry of a ManifestSource,
+// saved on its own by -dep-level-dedup.
+type ManifestDependencySnippet struct {
+	Section   string   `json:"section"`
+	Crate     string   `json:"crate"`
+	ShortHash string   `json:"short_hash"`
+	Comments  []string `json:"comments,omitempty"` // see cargosnip.Dependency.Comments
+}
+
+// fileName returns the name of the snippet file under cargo-deps/.
+func (d ManifestDependencySnippet) fileName() string {
+	return fmt.Sprintf("%s_%s.toml", safeSectionName(d.Crate), d.ShortHash)
+}
+
+// DependencySnippet is one unique dependency entry in cargo-deps/index.json:
+// every source that declares the crate with exactly this content.
+type DependencySnippet struct {
+	ShortHash string   `json:"short_hash"`
+	Path      string   `json:"path"` // relative to cargo-deps/
+	Sections  []string `json:"sections"`
+	Sources   []string `json:"sources"`
+	Comments  []string `json:"comments,omitempty"` // from every source, which the shared file drops
+}
+
+// DependencyUse records one dependency declared by a repository.
+type DependencyUse struct {
+	Repo     string   `json:"repo"` // owner/name
+	Section  string   `json:"section"`
+	Name     string   `json:"name"`
+	Version  string   `json:"version,omitempty"`  // version requirement, "" when none is declared
+	Git      string   `json:"git,omitempty"`      // git URL for git dependencies
+	GitRef   string   `json:"git_ref,omitempty"`  // e.g. "branch main"; "" for the default branch
+	Path     string   `json:"path,omitempty"`     // local path for path dependencies
+	Package  string   `json:"package,omitempty"`  // registry name when the dependency is renamed
+	Comments []string `json:"comments,omitempty"` // see cargosnip.Dependency.Comments
+}
+
+// crate returns the name of the crate the dependency refers to: Package
+// when the dependency is renamed, its key otherwise.
+func (u DependencyUse) crate() string {
+	if u.Package != "" {
+		return u.Package
 	}
+	return u.Name
+}
 
-	stats := Stats{
-		TotalRepos:    len(repos),
-		ReposWithDeps: make([]string, 0),
+// registryCrate returns the crates.io name of the dependency, or "" for git
+// and path dependencies, which do not come from the registry.
+func (u DependencyUse) registryCrate() string {
+	if u.Git != "" || u.Path != "" {
+		return ""
 	}
+	return u.crate()
+}
 
-	hashRegistry := make(HashRegistry)
+// SnippetIndex collects manifest bookkeeping per short hash while snippets
+// are saved. Sources are taken from the HashRegistry when it is written.
+type SnippetIndex map[string]*ManifestEntry
 
-	fmt.Printf("\nDownloading Cargo.toml files from %d repositories...\n", len(repos))
-	fmt.Printf("Output directory: %s\n", outputDir)
-	fmt.Printf("Grouped directory: %s\n", groupedDir)
-	fmt.Printf("Hash directory: %s\n", hashDir)
-	fmt.Println(strings.Repeat("-", 60))
+// verbose is shorthand for -log-level=debug.
+var verbose bool
 
-	for _, repoInfo := range repos {
-		fmt.Printf("Processing %s...\n", repoInfo.Name)
+// defaultOwner is the GitHub organization scanned when -owner is not given.
+const defaultOwner = "portal-co"
 
-		content, err := downloadCargoToml(owner, repoInfo.Name, repoInfo.DefaultBranch)
-		if err != nil {
-			stats.Failed++
-			continue
-		}
+// stringList is a flag.Value collecting repeated and/or comma-separated values.
+type stringList []string
 
-		stats.Downloaded++
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
 
-		// Save the full Cargo.toml
-		cargoTomlPath := filepath.Join(cargoTomlsDir, fmt.Sprintf("%s_Cargo.toml", repoInfo.Name))
-		fullContent := fmt.Sprintf("# Source: portal-co/%s\n# Auto-generated - do not edit\n\n%s", repoInfo.Name, content)
-		if err := os.WriteFile(cargoTomlPath, []byte(fullContent), 0644); err != nil {
-			fmt.Printf("  [ERROR] Failed to save Cargo.toml: %v\n", err)
-			continue
+func (l *stringList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
 		}
+	}
+	return nil
+}
 
-		// Extract dependency sections
-		sections := extractDependencySections(content)
+// githubToken authenticates GitHub requests when non-empty. It must never be
+// printed.
+var githubToken string
 
-		if len(sections) > 0 {
-			stats.ReposWithDeps = append(stats.ReposWithDeps, repoInfo.Name)
-			for sectionName, sectionContent := range sections {
-				// Save the full section
-				filepath := saveSnippet(outputDir, repoInfo.Name, sectionName, sectionContent)
-				stats.SectionsExtracted++
-				fmt.Printf("  -> Saved %s to %s\n", sectionName, filepath)
+// Public GitHub endpoints, used unless -api-base/-raw-base (or
+// $GITHUB_API_BASE/$GITHUB_RAW_BASE) point at a GitHub Enterprise instance.
+const (
+	defaultAPIBase = "https://api.github.com"
+	defaultRawBase = "https://raw.githubusercontent.com"
+)
 
-				// Split by blank lines and save grouped snippets with hash-based dedup
-				groups := splitByBlankLines(sectionContent)
-				for i, group := range groups {
-					symlinkPath, contentHash := saveGroupedSnippet(
-						groupedDir, hashDir, repoInfo.Name, sectionName, i+1, group, hashRegistry,
-					)
-					stats.GroupsExtracted++
-					fmt.Printf("     -> Group %d: %s -> %s.toml\n", i+1, filepath.Base(symlinkPath), contentHash)
-				}
-			}
-		}
-	}
+// apiBase and rawBase are the REST API and raw content roots, without a
+// trailing slash.
+var (
+	apiBase = defaultAPIBase
+	rawBase = defaultRawBase
+)
 
-	// Count unique hashes
-	stats.UniqueHashes = len(hashRegistry)
-	duplicates := 0
-	for _, sources := range hashRegistry {
-		if len(sources) > 1 {
-			duplicates++
-		}
-	}
+// httpTransport is shared by every HTTP client so that connections and TLS
+// sessions are reused across requests. run raises MaxIdleConnsPerHost to
+// -download-concurrency so each worker keeps its connection.
+var httpTransport = http.DefaultTransport.(*http.Transport).Clone()
 
-	fmt.Println(strings.Repeat("-", 60))
-	fmt.Println("\nSummary:")
-	fmt.Printf("  Total repositories: %d\n", stats.TotalRepos)
-	fmt.Printf("  Successfully downloaded: %d\n", stats.Downloaded)
-	fmt.Printf("  Failed: %d\n", stats.Failed)
-	fmt.Printf("  Dependency sections extracted: %d\n", stats.SectionsExtracted)
-	fmt.Printf("  Grouped snippets created: %d\n", stats.GroupsExtracted)
-	fmt.Printf("  Unique content hashes: %d\n", stats.UniqueHashes)
-	fmt.Printf("  Duplicated snippets: %d\n", duplicates)
-	fmt.Printf("  Repos with dependencies: %d\n", len(stats.ReposWithDeps))
+// downloadClient fetches raw Cargo.toml and Cargo.lock files. Its timeout is
+// set with -timeout.
+var downloadClient = &http.Client{Transport: httpTransport, Timeout: 10 * time.Second}
 
-	// Save summaries
-	saveSummaries(outputDir, groupedDir, hashDir, stats, hashRegistry, duplicates)
+// apiClient sends GitHub REST API requests: discovery and tree listings.
+var apiClient = &http.Client{Transport: httpTransport, Timeout: 30 * time.Second}
 
-	fmt.Printf("\nDone! Snippets saved to %s, %s, and %s\n", outputDir, groupedDir, hashDir)
-}
+// errNotFound reports that a repository has no Cargo.toml at the requested
+// path on any candidate branch. It is an expected outcome, not a failure to retry.
+var errNotFound = errors.New("no manifest found")
 
-func discoverRustRepos(owner string, perPage int) ([]RepoInfo, error) {
-	var repos []RepoInfo
-	page := 1
+// errUnauthorized reports that GitHub rejected the configured token.
+var errUnauthorized = errors.New("GitHub rejected the provided token (HTTP 401); check GITHUB_TOKEN or -token")
 
-	fmt.Printf("Discovering Rust repositories in %s...\n", owner)
+// countOnly computes the summary stats without writing any files.
+var countOnly bool
 
-	client := &http.Client{Timeout: 30 * time.Second}
+// dryRun runs the full pipeline but skips every filesystem write.
+var dryRun bool
 
-	for {
-		url := fmt.Sprintf("https://api.github.com/search/repositories?q=org:%s+language:Rust&per_page=%d&page=%d",
-			owner, perPage, page)
+// skipPathDeps drops path dependencies from grouped and hashed snippets,
+// since their relative paths do not resolve outside the source repository.
+// When false they are kept and the hashed snippet is tagged instead.
+var skipPathDeps = true
 
-		req, err := http.NewRequest("GET", url, nil)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create request: %w", err)
-		}
+// copyInsteadOfSymlink writes grouped snippets as copies of their hashed
+// file rather than symlinks.
+var copyInsteadOfSymlink bool
 
-		req.Header.Set("Accept", "application/vnd.github.v3+json")
-		req.Header.Set("User-Agent", "rice-snippets-downloader")
+// cargoAddScripts also writes, next to each section and grouped snippet, a
+// .sh file of the `cargo add` commands that apply it to a project.
+var cargoAddScripts bool
 
-		resp, err := client.Do(req)
-		if err != nil {
-			return nil, fmt.Errorf("failed to fetch repositories: %w", err)
-		}
+// combinedSnippets also writes a {repo}_all.toml per manifest holding all of
+// its dependency sections in their original order.
+var combinedSnippets bool
 
-		if resp.StatusCode != http.StatusOK {
-			resp.Body.Close()
-			return nil, fmt.Errorf("GitHub API error: %d", resp.StatusCode)
-		}
+// snippetFormat is the -format of hashed and grouped snippet bodies: toml,
+// json or yaml.
+var snippetFormat = "toml"
 
-		var searchResp GitHubSearchResponse
-		if err := json.NewDecoder(resp.Body).Decode(&searchResp); err != nil {
-			resp.Body.Close()
-			return nil, fmt.Errorf("failed to decode response: %w", err)
-		}
-		resp.Body.Close()
+// snippetFormats maps each -format to the extension of hashed and grouped
+// snippets. JSON bodies use .deps.json so that they do not clash with the
+// {hash}.json sidecars.
+var snippetFormats = map[string]string{"toml": ".toml", "json": ".deps.json", "yaml": ".yaml"}
 
-		if len(searchResp.Items) == 0 {
-			break
-		}
+// snippetExt returns the extension of hashed and grouped snippets.
+func snippetExt() string {
+	return snippetFormats[snippetFormat]
+}
 
-		repos = append(repos, searchResp.Items...)
+// minGroupSize is the fewest dependencies a group needs to be saved as a
+// grouped snippet.
+var minGroupSize = 1
 
-		if len(searchResp.Items) < perPage {
-			break
-		}
+// fallbackBranches are tried, in order, when a manifest is not found on the
+// repository's default branch. Set with -branches.
+var fallbackBranches = []string{"main", "master"}
 
-		page++
+// candidateBranches returns branch followed by fallbackBranches, without
+// repeats.
+func candidateBranches(branch string) []string {
+	candidates := []string{branch}
+	seen := map[string]bool{branch: true}
+	for _, b := range fallbackBranches {
+		if !seen[b] {
+			seen[b] = true
+			candidates = append(candidates, b)
+		}
 	}
+	return candidates
+}
 
-	if len(repos) == 0 {
-		return nil, fmt.Errorf("no repositories found via GitHub API")
-	}
+// retries is how many times a Cargo.toml download is retried after a
+// network error or 5xx response.
+var retries = 3
 
-	fmt.Printf("  Found %d Rust repositories\n", len(repos))
-	return repos, nil
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "\nError: %v\n", err)
+		os.Exit(1)
+	}
 }
 
-func downloadCargoToml(owner, repo, branch string) (string, error) {
-	client := &http.Client{Timeout: 10 * time.Second}
-	url := fmt.Sprintf("https://raw.githubusercontent.com/%s/%s/%s/Cargo.toml", owner, repo, branch)
-
-	req, err := http.NewRequest("GET", url, nil)
+// run parses the flags and performs one full download and extraction pass.
+// Per-repository failures are reported and counted in Stats; only errors
+// that abort the whole run are returned.
+func run() error {
+	cfg, err := parseFlags()
 	if err != nil {
-		return "", err
+		return err
 	}
-	req.Header.Set("User-Agent", "rice-snippets-downloader")
 
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Printf("  [ERROR] %v for %s\n", err, repo)
-		return "", err
+	if len(cfg.diffRepos) > 0 {
+		return diffRepoDependencies(os.Stdout, cfg.diffRepos, cfg.owners[0])
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusNotFound {
-		// Try alternate branch
-		altBranch := "main"
-		if branch == "main" {
-			altBranch = "master"
-		}
-		altURL := fmt.Sprintf("https://raw.githubusercontent.com/%s/%s/%s/Cargo.toml", owner, repo, altBranch)
+	paths, err := outputLayout(cfg.output, cfg.depLevelDedup)
+	if err != nil {
+		return err
+	}
 
-		req, err := http.NewRequest("GET", altURL, nil)
+	if cfg.compact {
+		files, bytes, err := compactHashedSnippets(paths.groupedDir, paths.hashDir)
 		if err != nil {
-			return "", err
+			return err
 		}
-		req.Header.Set("User-Agent", "rice-snippets-downloader")
+		fmt.Printf("Compacted %s: removed %d files, reclaimed %d bytes\n", paths.hashDir, files, bytes)
+		return nil
+	}
 
-		resp, err = client.Do(req)
+	categories := crateCategories{}
+	if cfg.categoriesFile != "" {
+		categories, err = loadCategories(cfg.categoriesFile)
 		if err != nil {
-			fmt.Printf("  [ERROR] %v for %s\n", err, repo)
-			return "", err
+			return err
 		}
-		defer resp.Body.Close()
+	}
 
-		if resp.StatusCode == http.StatusNotFound {
-			fmt.Printf("  [SKIP] No Cargo.toml found in %s\n", repo)
-			return "", fmt.Errorf("not found")
+	if !countOnly && !dryRun {
+		if err := paths.create(); err != nil {
+			return err
 		}
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		fmt.Printf("  [ERROR] HTTP %d for %s\n", resp.StatusCode, repo)
-		return "", fmt.Errorf("HTTP %d", resp.StatusCode)
+	sel, err := selectRepos(cfg, paths.stateDir)
+	if err != nil {
+		return err
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	p, err := newPipeline(cfg, paths, sel)
 	if err != nil {
-		fmt.Printf("  [ERROR] %v for %s\n", err, repo)
-		return "", err
+		return err
 	}
 
-	return string(body), nil
-}
+	slog.Info("downloading Cargo.toml files", "repos", len(sel.repos),
+		"output_dir", paths.outputDir, "grouped_dir", paths.groupedDir, "hash_dir", paths.hashDir)
 
-func extractDependencySections(content string) map[string]string {
-	sections := make(map[string]string)
-
-	sectionPatterns := []struct {
-		pattern *regexp.Regexp
-		name    string
-	}{
-		{regexp.MustCompile(`(?i)^\[dependencies\]`), "dependencies"},
-		{regexp.MustCompile(`(?i)^\[dev-dependencies\]`), "dev-dependencies"},
-		{regexp.MustCompile(`(?i)^\[build-dependencies\]`), "build-dependencies"},
-		{regexp.MustCompile(`(?i)^\[workspace\.dependencies\]`), "workspace.dependencies"},
-	}
-
-	lines := strings.Split(content, "\n")
-	var currentSection string
-	var currentContent []string
-	otherSectionPattern := regexp.MustCompile(`^\[.*\]$`)
-
-	for _, line := range lines {
-		stripped := strings.TrimSpace(line)
-
-		// Check if this line starts a new dependency section
-		var newSection string
-		for _, sp := range sectionPatterns {
-			if sp.pattern.MatchString(stripped) {
-				newSection = sp.name
-				break
-			}
+	results := p.fetch()
+	for _, result := range results {
+		if err := p.record(result); err != nil {
+			return err
 		}
+	}
+	p.carryOver()
 
-		// Check if this is any other section header
-		if newSection == "" && otherSectionPattern.MatchString(stripped) {
-			// End current section if we were in one
-			if currentSection != "" && len(currentContent) > 0 {
-				sections[currentSection] = strings.Join(currentContent, "\n")
-			}
-			currentSection = ""
-			currentContent = nil
-			continue
+	if cfg.prune && !countOnly {
+		var stems []string
+		for _, repoInfo := range append(sel.repos, sel.skipped.unfetched()...) {
+			stems = append(stems, repoStem(repoInfo, len(cfg.owners) > 1))
 		}
+		pruneStaleOutputs(paths.outputDir, paths.groupedDir, paths.hashDir, paths.cargoTomlsDir, p.listed, stems)
+	}
 
-		if newSection != "" {
-			// Save previous section if exists
-			if currentSection != "" && len(currentContent) > 0 {
-				sections[currentSection] = strings.Join(currentContent, "\n")
-			}
-			currentSection = newSection
-			currentContent = []string{line}
-		} else if currentSection != "" {
-			currentContent = append(currentContent, line)
+	duplicates := countHashes(&p.stats, p.out.hashRegistry)
+	printSummary(p.stats, duplicates, p.out)
+
+	if countOnly {
+		slog.Info("count-only run: no files were written")
+		return p.finish()
+	}
+
+	if err := p.writeReports(duplicates, categories); err != nil {
+		return err
+	}
+
+	if dryRun {
+		slog.Info("dry run: no files were written")
+		return p.finish()
+	}
+
+	slog.Info("done", "output_dir", paths.outputDir, "grouped_dir", paths.groupedDir, "hash_dir", paths.hashDir)
+	return p.finish()
+}
+
+// config holds the flags that run passes around, as opposed to the options
+// that parseFlags stores in package variables.
+type config struct {
+	failOnErrors        bool
+	maxFailures         int
+	concurrency         int
+	cratesIOConcurrency int
+	maxRepos            int
+	top                 int
+	monorepo            bool
+	members             bool
+	verifyCrates        bool
+	compact             bool
+	prune               bool
+	incremental         bool
+	depLevelDedup       bool
+	withPackage         bool
+	cargoLock           bool
+	filter              DiscoveryFilter
+	since               time.Duration
+	owners              stringList
+	output              string
+	local               string
+	reposFile           string
+	categoriesFile      string
+	diffRepos           stringList
+	crates              crateFilter
+}
+
+// parseFlags parses and validates the command line, applies the defaults
+// that depend on the environment and installs the logger.
+func parseFlags() (*config, error) {
+	cfg := &config{}
+	flag.BoolVar(&verbose, "verbose", false, "shorthand for -log-level=debug")
+	logLevel := flag.String("log-level", "info", "minimum log level: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "log output format: text or json")
+	flag.BoolVar(&dryRun, "dry-run", false, "run discovery, download, extraction and hashing but write nothing to disk")
+	flag.BoolVar(&countOnly, "count-only", false, "only compute sections/groups/unique hashes; write nothing")
+	flag.StringVar(&githubToken, "token", "", "GitHub token for authenticated requests (default $GITHUB_TOKEN)")
+	flag.StringVar(&apiBase, "api-base", "", "GitHub REST API base URL, e.g. https://github.example.com/api/v3 (default $GITHUB_API_BASE or "+defaultAPIBase+")")
+	flag.StringVar(&userAgent, "user-agent", userAgent, "User-Agent header of every GitHub and crates.io request")
+	flag.StringVar(&rawBase, "raw-base", "", "raw file content base URL (default $GITHUB_RAW_BASE or "+defaultRawBase+")")
+	flag.BoolVar(&skipPathDeps, "skip-path-deps", skipPathDeps, "exclude path dependencies from grouped snippets; when false, tag snippets that contain them")
+	flag.BoolVar(&copyInsteadOfSymlink, "copy-instead-of-symlink", false, "write grouped snippets as copies instead of symlinks")
+	flag.StringVar(&snippetFormat, "format", snippetFormat, "body format of hashed and grouped snippets: toml, json or yaml; hashes are the same for all three")
+	flag.BoolVar(&combinedSnippets, "combined", false, "also write a {repo}_all.toml per manifest with all of its dependency sections in file order")
+	flag.BoolVar(&cargoAddScripts, "cargo-add", false, "also write a .sh file of equivalent `cargo add` commands next to each section and grouped snippet")
+	flag.IntVar(&minGroupSize, "min-group-size", minGroupSize, "skip grouped snippets with fewer than this many dependencies")
+	flag.IntVar(&retries, "retries", retries, "retries per Cargo.toml download on network errors and 5xx responses")
+	var branches stringList
+	flag.Var(&branches, "branches", "comma-separated branches tried in order when a Cargo.toml is not on the default branch (default "+strings.Join(fallbackBranches, ",")+")")
+	flag.BoolVar(&cfg.failOnErrors, "fail-on-errors", false, "exit non-zero after writing the outputs when more than -max-failures repositories failed")
+	flag.IntVar(&cfg.maxFailures, "max-failures", 0, "failed repositories tolerated by -fail-on-errors")
+	flag.IntVar(&cfg.concurrency, "download-concurrency", 8, "number of repositories downloaded from GitHub in parallel")
+	flag.IntVar(&cfg.concurrency, "concurrency", cfg.concurrency, "alias of -download-concurrency")
+	flag.IntVar(&cfg.cratesIOConcurrency, "cratesio-concurrency", 2, "number of parallel crates.io lookups for -verify-crates; requests still start at most once per second")
+	flag.DurationVar(&downloadClient.Timeout, "timeout", downloadClient.Timeout, "timeout of each Cargo.toml or Cargo.lock download attempt; 0 disables it")
+	flag.IntVar(&cfg.maxRepos, "max-repos", 0, "process at most this many repositories, for quick test runs (default no limit)")
+	flag.IntVar(&cfg.top, "top", 20, "number of crates listed in most-common.toml")
+	flag.BoolVar(&cfg.monorepo, "monorepo", false, "also download every nested Cargo.toml found via the Git Trees API")
+	flag.BoolVar(&cfg.members, "workspace-members", false, "also download the Cargo.toml of each [workspace] members entry of the root manifest; globs are expanded with one Git Trees API call (ignored with -monorepo)")
+	flag.BoolVar(&cfg.verifyCrates, "verify-crates", false, "look up every crate on crates.io and write missing-crates.md and yanked-dependencies.md")
+	flag.BoolVar(&cfg.compact, "compact", false, "only delete hashed snippets that no grouped snippet links to, print the space reclaimed and exit")
+	flag.BoolVar(&cfg.prune, "prune", false, "delete outputs of repositories not listed in this run and drop them from hashed snippet sources")
+	flag.BoolVar(&cfg.incremental, "incremental", false, "reuse the previous manifest.json for unchanged Cargo.toml files and prune vanished sources")
+	flag.BoolVar(&cfg.depLevelDedup, "dep-level-dedup", false, "also save every dependency entry as its own hashed snippet under cargo-deps/ with a per-crate index")
+	flag.BoolVar(&cfg.withPackage, "package-metadata", false, "record the [package] name, version, edition and rust-version of each manifest in manifest.json")
+	flag.BoolVar(&cfg.cargoLock, "cargo-lock", false, "also download each Cargo.lock and write resolved-versions.md")
+	flag.BoolVar(&cfg.filter.IncludeArchived, "include-archived", false, "include archived repositories")
+	flag.BoolVar(&cfg.filter.IncludeForks, "include-forks", false, "include forked repositories")
+	flag.DurationVar(&cfg.since, "since", 0, "skip repositories not pushed to within this duration, e.g. 720h (default no limit)")
+	flag.Var(&cfg.owners, "owner", "GitHub organization or user to scan; repeat or comma-separate for several (default "+defaultOwner+")")
+	flag.StringVar(&cfg.output, "output", "", "base directory for cargo/, cargo-grouped/, cargo-hashed/, cargo-tomls/, manifest.json and etags.json (default: the repository containing this script)")
+	flag.StringVar(&cfg.local, "local", "", "read Cargo.toml files from this directory tree instead of GitHub; each becomes a pseudo-repository "+localOwner+"/<relative dir>")
+	var sections stringList
+	flag.Var(&sections, "sections", "comma-separated sections to extract, from "+strings.Join(cargosnip.SectionKinds, ", ")+" (default all)")
+	flag.StringVar(&cfg.reposFile, "repos-file", "", "process the owner/repo[@branch] lines of this file instead of discovering repositories")
+	flag.StringVar(&cfg.categoriesFile, "categories-file", "", "file of \"category: crate, glob*\" lines that assign crates to by-category/ snippets, tried before the built-in categories")
+	flag.Var(&cfg.diffRepos, "diff", "compare the dependencies of two repositories, given as repoA,repoB (owner/repo[@branch], or a repo of the first -owner), print the differences and exit")
+	flag.Var(&cfg.crates.allow, "allow-crates", "comma-separated crate name globs; only matching crates appear in the aggregate reports (default all)")
+	flag.Var(&cfg.crates.block, "block-crates", "comma-separated crate name globs left out of the aggregate reports; wins over -allow-crates")
+	flag.Parse()
+
+	if len(cfg.owners) == 0 {
+		cfg.owners = stringList{defaultOwner}
+	}
+	if len(branches) > 0 {
+		fallbackBranches = branches
+	}
+	if cfg.concurrency < 1 {
+		cfg.concurrency = 1
+	}
+	if cfg.cratesIOConcurrency < 1 {
+		cfg.cratesIOConcurrency = 1
+	}
+	if cfg.concurrency > httpTransport.MaxIdleConnsPerHost {
+		httpTransport.MaxIdleConnsPerHost = cfg.concurrency
+	}
+	if retries < 0 {
+		retries = 0
+	}
+	if cfg.since > 0 {
+		cfg.filter.PushedSince = time.Now().Add(-cfg.since)
+	}
+	if _, ok := snippetFormats[snippetFormat]; !ok {
+		return nil, fmt.Errorf("unknown -format %q: want toml, json or yaml", snippetFormat)
+	}
+	if err := cfg.crates.validate(); err != nil {
+		return nil, err
+	}
+	if len(sections) > 0 {
+		enabled, err := parseSectionKinds(sections)
+		if err != nil {
+			return nil, err
 		}
+		enabledSections = enabled
 	}
 
-	// Don't forget the last section
-	if currentSection != "" && len(currentContent) > 0 {
-		sections[currentSection] = strings.Join(currentContent, "\n")
+	if githubToken == "" {
+		githubToken = os.Getenv("GITHUB_TOKEN")
 	}
+	apiBase = strings.TrimSuffix(firstNonEmpty(apiBase, os.Getenv("GITHUB_API_BASE"), defaultAPIBase), "/")
+	rawBase = strings.TrimSuffix(firstNonEmpty(rawBase, os.Getenv("GITHUB_RAW_BASE"), defaultRawBase), "/")
 
-	return sections
+	if verbose {
+		*logLevel = "debug"
+	}
+	logger, err := newLogger(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		return nil, err
+	}
+	slog.SetDefault(logger)
+	return cfg, nil
 }
 
-func splitByBlankLines(content string) []string {
-	lines := strings.Split(content, "\n")
-	var groups []string
-	var currentGroup []string
-	inMultiline := false
-	bracketCount := 0
+// outputPaths are the directories and files a run reads and writes.
+type outputPaths struct {
+	snippetsDir   string
+	stateDir      string // holds cargo-tomls/, etags.json and .snippetignore
+	outputDir     string
+	groupedDir    string
+	hashDir       string
+	depsDir       string // "" without -dep-level-dedup
+	cargoTomlsDir string
+	etagsPath     string
+	manifestPath  string
+	categoriesDir string
+}
 
-	// Skip the section header line (e.g., [dependencies])
-	startIdx := 0
-	sectionHeaderPattern := regexp.MustCompile(`^\[.*\]$`)
-	for i, line := range lines {
-		if sectionHeaderPattern.MatchString(strings.TrimSpace(line)) {
-			startIdx = i + 1
-			break
+// outputLayout returns the paths under output. Without -output, snippets/
+// and cargo-tomls/ sit in the repository that contains this script.
+func outputLayout(output string, depLevelDedup bool) (outputPaths, error) {
+	snippetsDir, stateDir := output, output
+	if output == "" {
+		scriptDir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+		if err != nil {
+			return outputPaths{}, fmt.Errorf("getting script directory: %w", err)
+		}
+		repoRoot := filepath.Dir(scriptDir)
+		snippetsDir, stateDir = filepath.Join(repoRoot, "snippets"), repoRoot
+	}
+	paths := outputPaths{
+		snippetsDir:   snippetsDir,
+		stateDir:      stateDir,
+		outputDir:     filepath.Join(snippetsDir, "cargo"),
+		groupedDir:    filepath.Join(snippetsDir, "cargo-grouped"),
+		hashDir:       filepath.Join(snippetsDir, "cargo-hashed"),
+		cargoTomlsDir: filepath.Join(stateDir, "cargo-tomls"),
+		etagsPath:     filepath.Join(stateDir, "etags.json"),
+		manifestPath:  filepath.Join(snippetsDir, "manifest.json"),
+		categoriesDir: filepath.Join(snippetsDir, "by-category"),
+	}
+	if depLevelDedup {
+		paths.depsDir = filepath.Join(snippetsDir, "cargo-deps")
+	}
+	return paths, nil
+}
+
+// create makes the output directories.
+func (p outputPaths) create() error {
+	for _, dir := range []string{p.outputDir, p.groupedDir, p.hashDir, p.cargoTomlsDir, p.depsDir, p.categoriesDir} {
+		if dir == "" {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("creating directory %s: %w", dir, err)
 		}
 	}
+	return nil
+}
 
-	for _, line := range lines[startIdx:] {
-		stripped := strings.TrimSpace(line)
+// repoSelection is the set of repositories one run processes.
+type repoSelection struct {
+	repos          []RepoInfo
+	localManifests map[string]string // Cargo.toml per pseudo-repository with -local
+	skipped        SkipCounts
+	ignore         *snippetIgnore
+	ignoredRepos   int
+}
 
-		// Track multiline entries (count brackets)
-		if !inMultiline {
-			openCount := strings.Count(line, "[") + strings.Count(line, "{")
-			closeCount := strings.Count(line, "]") + strings.Count(line, "}")
-			if openCount > closeCount {
-				inMultiline = true
-				bracketCount = openCount - closeCount
+// selectRepos finds the repositories to process: those under -local, those
+// listed in -repos-file, or the Rust repositories of every -owner, skipping
+// repeats. Repositories .snippetignore excludes or beyond -max-repos are
+// dropped. With -local or -repos-file, cfg.owners is set to the owners of
+// the selected repositories.
+func selectRepos(cfg *config, stateDir string) (*repoSelection, error) {
+	sel := &repoSelection{}
+	var err error
+	switch {
+	case cfg.local != "":
+		sel.repos, sel.localManifests, err = findLocalRepos(cfg.local)
+		if err != nil {
+			return nil, err
+		}
+		cfg.owners = stringList{localOwner}
+	case cfg.reposFile != "":
+		sel.repos, err = loadReposFile(cfg.reposFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.owners = reposOwners(sel.repos)
+	default:
+		seenRepos := make(map[string]bool)
+		for _, owner := range cfg.owners {
+			found, ownerSkipped, err := discoverRustRepos(owner, 100, cfg.filter)
+			if err != nil {
+				return nil, fmt.Errorf("discovering repositories: %w", err)
 			}
-		} else {
-			openCount := strings.Count(line, "[") + strings.Count(line, "{")
-			closeCount := strings.Count(line, "]") + strings.Count(line, "}")
-			bracketCount += openCount - closeCount
-			if bracketCount <= 0 {
-				inMultiline = false
-				bracketCount = 0
-			}
-		}
-
-		// Check for blank line
-		if stripped == "" && !inMultiline {
-			if len(currentGroup) > 0 {
-				// Filter out comment-only groups and malformed snippets
-				hasDeps := false
-				for _, l := range currentGroup {
-					trimmed := strings.TrimSpace(l)
-					if trimmed != "" && !strings.HasPrefix(trimmed, "#") && strings.Contains(l, "=") {
-						hasDeps = true
-						break
-					}
+			sel.skipped.Archived += ownerSkipped.Archived
+			sel.skipped.Forks += ownerSkipped.Forks
+			sel.skipped.Stale = append(sel.skipped.Stale, ownerSkipped.Stale...)
+			for _, repoInfo := range found {
+				if !seenRepos[repoInfo.FullName] {
+					seenRepos[repoInfo.FullName] = true
+					sel.repos = append(sel.repos, repoInfo)
 				}
-				if hasDeps {
-					groups = append(groups, strings.Join(currentGroup, "\n"))
-				}
-				currentGroup = nil
 			}
-		} else {
-			currentGroup = append(currentGroup, line)
 		}
+		// Search results come back in relevance order, which can shift
+		// between runs
+		sort.Slice(sel.repos, func(i, j int) bool {
+			return sel.repos[i].FullName < sel.repos[j].FullName
+		})
 	}
 
-	// Don't forget the last group
-	if len(currentGroup) > 0 {
-		hasDeps := false
-		for _, l := range currentGroup {
-			trimmed := strings.TrimSpace(l)
-			if trimmed != "" && !strings.HasPrefix(trimmed, "#") && strings.Contains(l, "=") {
-				hasDeps = true
-				break
-			}
-		}
-		if hasDeps {
-			groups = append(groups, strings.Join(currentGroup, "\n"))
-		}
+	sel.ignore, err = loadSnippetIgnore(filepath.Join(stateDir, ".snippetignore"))
+	if err != nil {
+		return nil, err
+	}
+	sel.repos, sel.ignoredRepos = sel.ignore.filterRepos(sel.repos)
+	if cfg.maxRepos > 0 && len(sel.repos) > cfg.maxRepos {
+		sel.skipped.OverLimit = sel.repos[cfg.maxRepos:]
+		sel.repos = sel.repos[:cfg.maxRepos]
 	}
 
-	return groups
+	if len(sel.repos) == 0 && len(sel.skipped.Stale) > 0 {
+		return nil, fmt.Errorf("no repositories pushed to within -since %s (%d skipped)", cfg.since, len(sel.skipped.Stale))
+	}
+	if len(sel.repos) == 0 {
+		return nil, errors.New("no repositories found")
+	}
+	return sel, nil
 }
 
-func computeContentHash(content string) string {
-	lines := strings.Split(content, "\n")
-	var contentLines []string
+// pipeline is the state of one run between selecting the repositories and
+// writing the reports. Everything but fetch runs on the caller's goroutine.
+type pipeline struct {
+	cfg   *config
+	paths outputPaths
+	sel   *repoSelection
+	stats Stats
+	out   *runOutput
+	etags *ETagCache
 
-	for _, line := range lines {
-		stripped := strings.TrimSpace(line)
-		// Skip metadata comments at the start
-		if strings.HasPrefix(stripped, "# Source:") ||
-			strings.HasPrefix(stripped, "# Section:") ||
-			strings.HasPrefix(stripped, "# Auto-generated") {
-			continue
-		}
-		contentLines = append(contentLines, line)
-	}
+	// previous is the manifest of the last run, kept for changes.md;
+	// previousSources and previousSnippets index it for -incremental
+	previous         Manifest
+	previousSources  map[string]ManifestSource
+	previousSnippets map[string]ManifestEntry
 
-	cleanContent := strings.TrimSpace(strings.Join(contentLines, "\n"))
-	hash := sha256.Sum256([]byte(cleanContent))
-	return hex.EncodeToString(hash[:])
+	// inconclusive holds the repositories whose fetch was inconclusive;
+	// they keep their previous sources
+	inconclusive map[string]bool
+	// listed holds every repository this run knows to exist, fetched or not
+	listed   map[string]bool
+	resolved map[string][]LockedPackage // Cargo.lock packages by repository
 }
 
-func saveSnippet(outputDir, repo, sectionName, content string) string {
-	safeSection := strings.ReplaceAll(strings.ReplaceAll(sectionName, ".", "-"), "/", "-")
-	filename := fmt.Sprintf("%s_%s.toml", repo, safeSection)
-	filepath := filepath.Join(outputDir, filename)
+// newPipeline prepares the stats and output state for sel and loads the
+// ETag cache and the previous manifest.
+func newPipeline(cfg *config, paths outputPaths, sel *repoSelection) (*pipeline, error) {
+	p := &pipeline{
+		cfg:   cfg,
+		paths: paths,
+		sel:   sel,
+		stats: Stats{
+			TotalRepos:      len(sel.repos),
+			SkippedArchived: sel.skipped.Archived,
+			SkippedForks:    sel.skipped.Forks,
+			SkippedStale:    len(sel.skipped.Stale),
+			SkippedMaxRepos: len(sel.skipped.OverLimit),
+			IgnoredRepos:    sel.ignoredRepos,
+			ReposWithDeps:   make([]string, 0),
+		},
+		previousSources:  make(map[string]ManifestSource),
+		previousSnippets: make(map[string]ManifestEntry),
+		inconclusive:     make(map[string]bool),
+		resolved:         make(map[string][]LockedPackage),
+	}
+	p.out = &runOutput{
+		outputDir:    paths.outputDir,
+		groupedDir:   paths.groupedDir,
+		hashDir:      paths.hashDir,
+		stats:        &p.stats,
+		hashRegistry: make(HashRegistry),
+		snippetIndex: make(SnippetIndex),
+		sources:      make(map[string]*ManifestSource),
+		depsDir:      paths.depsDir,
+		depSnippets:  make(map[string]map[string]*DependencySnippet),
+	}
 
-	fullContent := fmt.Sprintf("# Source: portal-co/%s\n# Section: [%s]\n# Auto-generated - do not edit\n\n%s\n",
-		repo, sectionName, content)
+	if countOnly {
+		return p, nil
+	}
 
-	if err := os.WriteFile(filepath, []byte(fullContent), 0644); err != nil {
-		fmt.Printf("  [ERROR] Failed to save snippet: %v\n", err)
+	var err error
+	p.etags, err = loadETagCache(paths.etagsPath)
+	if err != nil {
+		return nil, fmt.Errorf("loading ETag cache: %w", err)
 	}
 
-	return filename
+	p.previous, err = loadManifest(paths.manifestPath)
+	if err != nil && cfg.incremental {
+		return nil, fmt.Errorf("loading previous manifest: %w", err)
+	} else if err != nil {
+		slog.Warn("could not load previous manifest; changes.md will list every snippet as added", "err", err)
+	}
+	if cfg.incremental {
+		for _, source := range p.previous.Sources {
+			p.previousSources[source.Source] = source
+		}
+		for _, entry := range p.previous.Snippets {
+			p.previousSnippets[entry.ShortHash] = entry
+		}
+	}
+	return p, nil
 }
 
-func saveHashedSnippet(hashDir, content string, sources []string) (string, string) {
-	contentHash := computeContentHash(content)
-	shortHash := contentHash[:16]
-	filename := fmt.Sprintf("%s.toml", shortHash)
-	filepath := filepath.Join(hashDir, filename)
+// fetch downloads and parses the selected repositories concurrently and
+// returns the results in selection order, so the hash registry and stats
+// are only touched from the caller's goroutine. An interrupt stops new
+// downloads; the repositories it kept from being fetched are counted as not
+// processed and keep their previous results, like inconclusive fetches.
+func (p *pipeline) fetch() []repoResult {
+	opts := fetchOptions{
+		cargoTomlsDir: p.paths.cargoTomlsDir,
+		etags:         p.etags,
+		monorepo:      p.cfg.monorepo,
+		members:       p.cfg.members,
+		lockfile:      p.cfg.cargoLock,
+	}
+	multiOwner := len(p.cfg.owners) > 1
+	repos := p.sel.repos
+	results := fetchRepos(repos, p.cfg.concurrency, newProgressReporter(len(repos)), interruptChannel(), func(repoInfo RepoInfo) repoResult {
+		stem := repoStem(repoInfo, multiOwner)
+		if p.sel.localManifests != nil {
+			return processLocalRepo(repoInfo, stem, p.sel.localManifests[repoInfo.FullName], opts)
+		}
+		return processRepo(repoInfo, stem, opts)
+	})
 
-	// Check if file exists
-	if _, err := os.Stat(filepath); os.IsNotExist(err) {
-		// Create new file
-		fullContent := fmt.Sprintf("# Hash: %s\n# Sources: %s\n# Auto-generated - do not edit\n\n%s\n",
-			contentHash, strings.Join(sources, ", "), content)
-		if err := os.WriteFile(filepath, []byte(fullContent), 0644); err != nil {
-			fmt.Printf("  [ERROR] Failed to save hashed snippet: %v\n", err)
+	p.stats.NotProcessed = len(repos) - len(results)
+	if p.stats.NotProcessed > 0 {
+		fetched := make(map[string]bool, len(results))
+		for _, result := range results {
+			fetched[result.repo.FullName] = true
 		}
-	} else {
-		// Update sources in existing file
-		existingContent, err := os.ReadFile(filepath)
-		if err != nil {
-			return filepath, shortHash
+		for _, repoInfo := range repos {
+			if !fetched[repoInfo.FullName] {
+				p.inconclusive[repoInfo.FullName] = true
+			}
 		}
+	}
+	return results
+}
 
-		// Parse existing sources
-		lines := strings.Split(string(existingContent), "\n")
-		var existingSources []string
-		for _, line := range lines {
-			if strings.HasPrefix(line, "# Sources:") {
-				sourcesStr := strings.TrimPrefix(line, "# Sources:")
-				for _, s := range strings.Split(sourcesStr, ",") {
-					existingSources = append(existingSources, strings.TrimSpace(s))
-				}
-				break
+// record registers the hashes of one fetched repository and, unless
+// -count-only is set, writes its Cargo.toml files and snippets. It only
+// returns an error when GitHub rejected the token; other failures are
+// logged and counted.
+func (p *pipeline) record(result repoResult) error {
+	repoInfo := result.repo
+	slog.Debug("processing repository", "repo", repoInfo.FullName)
+
+	if errors.Is(result.err, errUnauthorized) {
+		return fmt.Errorf("downloading Cargo.toml: %w", result.err)
+	}
+	if result.err != nil {
+		reportDownloadError(repoInfo.FullName, result.err)
+		p.stats.Failed++
+		if !errors.Is(result.err, errNotFound) {
+			p.inconclusive[repoInfo.FullName] = true
+		}
+		return nil
+	}
+
+	p.stats.Downloaded++
+
+	if errors.Is(result.treeErr, errUnauthorized) {
+		return fmt.Errorf("listing Cargo.toml files: %w", result.treeErr)
+	}
+	if result.treeErr != nil {
+		slog.Error("failed to list Cargo.toml files", "repo", repoInfo.FullName, "err", result.treeErr)
+		p.inconclusive[repoInfo.FullName] = true
+	}
+	if errors.Is(result.lockErr, errUnauthorized) {
+		return fmt.Errorf("downloading Cargo.lock: %w", result.lockErr)
+	}
+	if result.lockErr != nil {
+		reportDownloadError(repoInfo.FullName, result.lockErr)
+	} else if len(result.locked) > 0 {
+		p.resolved[repoInfo.FullName] = result.locked
+	}
+
+	// Entries inheriting from the workspace resolve against the root manifest
+	workspace := workspaceDependencies(result.manifests[0].sections)
+	out := p.out
+
+	hasDeps := false
+	for _, m := range result.manifests {
+		if errors.Is(m.err, errUnauthorized) {
+			return fmt.Errorf("downloading Cargo.toml: %w", m.err)
+		}
+		if m.err != nil {
+			reportDownloadError(m.source(repoInfo), m.err)
+			if !errors.Is(m.err, errNotFound) {
+				p.inconclusive[repoInfo.FullName] = true
 			}
+			continue
+		}
+		if m.member != "" {
+			p.stats.MemberManifests++
 		}
+		source := m.source(repoInfo)
+		m.sections = p.sel.ignore.filterSections(repoInfo.FullName, m.sections, &p.stats)
 
-		// Add new sources and deduplicate
-		sourceMap := make(map[string]bool)
-		for _, s := range existingSources {
-			sourceMap[s] = true
+		if countOnly {
+			countSections(source, m.sections, workspace, &p.stats, out.hashRegistry)
+			hasDeps = hasDeps || len(m.sections) > 0
+			continue
 		}
-		for _, s := range sources {
-			sourceMap[s] = true
+
+		if prev, ok := p.previousSources[source]; ok && m.unchanged {
+			p.stats.Unchanged++
+			slog.Debug("Cargo.toml unchanged, reusing previous results", "repo", source)
+			out.reuseSource(prev, p.previousSnippets)
+			if p.cfg.withPackage {
+				out.source(source, repoInfo.FullName).Package = packageMetadata(m.content, result.manifests[0].content)
+			}
+			hasDeps = hasDeps || len(prev.Sections) > 0
+			continue
 		}
 
-		var allSources []string
-		for s := range sourceMap {
-			allSources = append(allSources, s)
+		record := out.source(source, repoInfo.FullName)
+		record.Branch = m.branch
+		if p.cfg.withPackage {
+			record.Package = packageMetadata(m.content, result.manifests[0].content)
 		}
-		sort.Strings(allSources)
 
-		// Rewrite with updated sources
-		for i, line := range lines {
-			if strings.HasPrefix(line, "# Sources:") {
-				lines[i] = fmt.Sprintf("# Sources: %s", strings.Join(allSources, ", "))
-				break
+		// Save the full Cargo.toml unless GitHub reported it unchanged
+		if m.unchanged {
+			p.stats.Unchanged++
+			slog.Debug("Cargo.toml unchanged, reusing cached copy", "repo", source, "file", filepath.Base(m.cargoTomlPath))
+		} else {
+			fullContent := fmt.Sprintf("# Source: %s\n# Auto-generated - do not edit\n\n%s", record.ref(), m.content)
+			if err := writeFile(m.cargoTomlPath, []byte(fullContent), 0644); err != nil {
+				slog.Error("failed to save Cargo.toml", "repo", source, "err", err)
+				continue
 			}
 		}
 
-		if err := os.WriteFile(filepath, []byte(strings.Join(lines, "\n")), 0644); err != nil {
-			fmt.Printf("  [ERROR] Failed to update hashed snippet: %v\n", err)
+		if len(m.sections) > 0 {
+			hasDeps = true
+			if err := out.saveSections(m.stem, repoInfo.FullName, source, m.sections, workspace); err != nil {
+				slog.Error("failed to save snippets", "repo", source, "err", err)
+			}
+			if combinedSnippets {
+				if err := out.saveCombinedSnippet(out.source(source, repoInfo.FullName), m.stem, m.sections, cargosnip.DependencySectionOrder(m.content)); err != nil {
+					slog.Error("failed to save combined snippet", "repo", source, "err", err)
+				}
+			}
 		}
 	}
-
-	return filepath, shortHash
+	if hasDeps {
+		p.stats.ReposWithDeps = append(p.stats.ReposWithDeps, repoInfo.FullName)
+	}
+	return nil
 }
 
-func createSymlink(symlinkPath, targetPath string) {
-	// Remove existing file/symlink if it exists
-	os.Remove(symlinkPath)
-
-	// Create relative symlink
-	symlinkDir := filepath.Dir(symlinkPath)
-	relTarget, err := filepath.Rel(symlinkDir, targetPath)
-	if err != nil {
-		fmt.Printf("  [ERROR] Failed to create relative path: %v\n", err)
-		return
+// carryOver keeps the previous sources of inconclusive fetches and prunes
+// those that are gone: members removed from a repository processed in full,
+// and repositories no longer discovered (never for an explicit -repos-file).
+// Repositories skipped by -since or -max-repos still exist; they are just
+// not re-fetched.
+func (p *pipeline) carryOver() {
+	unfetched := p.sel.skipped.unfetched()
+	p.listed = seenRepoNames(append(p.sel.repos, unfetched...))
+	for _, repoInfo := range unfetched {
+		p.inconclusive[repoInfo.FullName] = true
 	}
 
-	if err := os.Symlink(relTarget, symlinkPath); err != nil {
-		fmt.Printf("  [ERROR] Failed to create symlink: %v\n", err)
+	for _, prev := range p.previousSources {
+		if p.out.sources[prev.Source] != nil {
+			continue
+		}
+		if p.inconclusive[prev.Repo] || !p.listed[prev.Repo] && p.cfg.reposFile != "" {
+			p.out.reuseSource(prev, p.previousSnippets)
+			continue
+		}
+		pruneSourceFiles(prev)
 	}
 }
 
-func saveGroupedSnippet(groupedDir, hashDir, repo, sectionName string, groupIndex int,
-	content string, hashRegistry HashRegistry) (string, string) {
-
-	contentHash := computeContentHash(content)
-	shortHash := contentHash[:16]
-
-	// Source identifier for this snippet
-	safeSection := strings.ReplaceAll(strings.ReplaceAll(sectionName, ".", "-"), "/", "-")
-	sourceID := fmt.Sprintf("%s/%s/group%02d", repo, safeSection, groupIndex)
-
-	// Track sources for this hash
-	hashRegistry[shortHash] = append(hashRegistry[shortHash], sourceID)
-
-	// Save to hash-based file
-	hashFile, _ := saveHashedSnippet(hashDir, content, []string{sourceID})
-
-	// Create symlink with the friendly name
-	symlinkName := fmt.Sprintf("%s_%s_group%02d.toml", repo, safeSection, groupIndex)
-	symlinkPath := filepath.Join(groupedDir, symlinkName)
-	createSymlink(symlinkPath, hashFile)
-
-	return symlinkPath, shortHash
+// finish returns the final error of the run: nil unless it was interrupted
+// or, with -fail-on-errors, too many repositories failed.
+func (p *pipeline) finish() error {
+	if p.stats.NotProcessed > 0 {
+		return fmt.Errorf("interrupted: %d of %d repositories were not processed; outputs are partial",
+			p.stats.NotProcessed, p.stats.TotalRepos)
+	}
+	if p.cfg.failOnErrors && p.stats.Failed > p.cfg.maxFailures {
+		return fmt.Errorf("%d of %d repositories failed, more than -max-failures=%d allows",
+			p.stats.Failed, p.stats.TotalRepos, p.cfg.maxFailures)
+	}
+	return nil
 }
 
-func saveSummaries(outputDir, groupedDir, hashDir string, stats Stats, hashRegistry HashRegistry, duplicates int) {
-	// Save summary for main snippets
-	summaryPath := filepath.Join(outputDir, "README.md")
-	var sb strings.Builder
-	sb.WriteString("# Cargo Dependency Snippets\n\n")
-	sb.WriteString("This directory contains dependency sections extracted from Cargo.toml files\n")
-	sb.WriteString("across the portal-co organization repositories.\n\n")
-	sb.WriteString("## Usage\n\n")
-	sb.WriteString("These snippets can be used as templates for new Rust projects.\n")
+// countHashes fills in the unique hash, most shared snippet and dedup ratio
+// stats from hashRegistry and returns how many hashes have more than one
+// source.
+func countHashes(stats *Stats, hashRegistry HashRegistry) int {
+	stats.UniqueHashes = len(hashRegistry)
+	duplicates := 0
+	for hash, sources := range hashRegistry {
+		if len(sources) > 1 {
+			duplicates++
+		}
+		if len(sources) > stats.MostSharedSources || len(sources) == stats.MostSharedSources && hash < stats.MostSharedHash {
+			stats.MostSharedHash, stats.MostSharedSources = hash, len(sources)
+		}
+	}
+	if stats.GroupsExtracted > 0 {
+		stats.DedupRatio = 1 - float64(stats.UniqueHashes)/float64(stats.GroupsExtracted)
+	}
+	return duplicates
+}
+
+// printSummary prints the stats of the run to stdout.
+func printSummary(stats Stats, duplicates int, out *runOutput) {
+	fmt.Println("Summary:")
+	fmt.Printf("  Total repositories: %d\n", stats.TotalRepos)
+	fmt.Printf("  Skipped archived: %d\n", stats.SkippedArchived)
+	fmt.Printf("  Skipped forks: %d\n", stats.SkippedForks)
+	fmt.Printf("  Skipped not pushed since -since: %d\n", stats.SkippedStale)
+	if stats.SkippedMaxRepos > 0 {
+		fmt.Printf("  Skipped beyond -max-repos: %d\n", stats.SkippedMaxRepos)
+	}
+	fmt.Printf("  Ignored by .snippetignore: %d repositories, %d sections\n", stats.IgnoredRepos, stats.IgnoredSections)
+	fmt.Printf("  Successfully downloaded: %d\n", stats.Downloaded)
+	fmt.Printf("  Failed: %d\n", stats.Failed)
+	if stats.NotProcessed > 0 {
+		fmt.Printf("  Not processed (interrupted): %d\n", stats.NotProcessed)
+	}
+	fmt.Printf("  Unchanged since last run: %d\n", stats.Unchanged)
+	fmt.Printf("  Workspace member manifests: %d\n", stats.MemberManifests)
+	fmt.Printf("  Path dependencies skipped: %d\n", stats.PathDepsSkipped)
+	fmt.Printf("  Groups below -min-group-size: %d\n", stats.SmallGroupsSkipped)
+	fmt.Printf("  Dependency sections extracted: %d\n", stats.SectionsExtracted)
+	fmt.Printf("  Grouped snippets created: %d\n", stats.GroupsExtracted)
+	fmt.Printf("  Unique content hashes: %d\n", stats.UniqueHashes)
+	fmt.Printf("  Duplicated snippets: %d\n", duplicates)
+	fmt.Printf("  Dedup ratio: %.1f%%\n", stats.DedupRatio*100)
+	if stats.MostSharedSources > 1 {
+		fmt.Printf("  Most shared snippet: %s%s (%d sources)\n", stats.MostSharedHash, snippetExt(), stats.MostSharedSources)
+	}
+	if out.depsDir != "" && !countOnly {
+		unique, shared := 0, 0
+		for _, byFile := range out.depSnippets {
+			for _, snippet := range byFile {
+				unique++
+				if len(snippet.Sources) > 1 {
+					shared++
+				}
+			}
+		}
+		fmt.Printf("  Unique dependency snippets: %d (%d shared)\n", unique, shared)
+	}
+	fmt.Printf("  Repos with dependencies: %d\n", len(stats.ReposWithDeps))
+	if stats.SnippetFiles > 0 {
+		fmt.Printf("  Snippet size: %d files, %d bytes, %d lines (average %d bytes)\n",
+			stats.SnippetFiles, stats.SnippetBytes, stats.SnippetLines, stats.SnippetBytes/int64(stats.SnippetFiles))
+		fmt.Printf("  Grouped snippets: %d bytes, stored as %d hashed bytes\n", stats.GroupedBytes, stats.HashedBytes)
+		fmt.Printf("  Largest snippet: %s (%s, %d bytes)\n", stats.LargestSnippet, stats.LargestSnippetSource, stats.LargestSnippetBytes)
+	}
+}
+
+// writeReports saves the ETag cache, the manifest, the READMEs and the
+// aggregate reports. Reports only cover the crates -allow-crates and
+// -block-crates select; snippets and the manifest keep every dependency.
+func (p *pipeline) writeReports(duplicates int, categories crateCategories) error {
+	paths, stats, out := p.paths, p.stats, p.out
+	dependencyUses := p.cfg.crates.filter(out.dependencyUses)
+
+	if err := saveETagCache(paths.etagsPath, p.etags); err != nil {
+		slog.Error("failed to save ETag cache", "err", err)
+	}
+
+	// Save summaries
+	if err := saveSummaries(paths.outputDir, paths.groupedDir, paths.hashDir, p.cfg.owners, stats, out.hashRegistry, duplicates, dependencyUses); err != nil {
+		return fmt.Errorf("summary generation partially failed; READMEs may be stale:\n%w", err)
+	}
+
+	if err := saveManifest(paths.manifestPath, out.hashRegistry, out.snippetIndex, out.sources); err != nil {
+		return fmt.Errorf("writing %s: %w", paths.manifestPath, err)
+	}
+
+	changesPath := filepath.Join(paths.snippetsDir, "changes.md")
+	if err := writeFile(changesPath, []byte(changesReport(p.previous, out.hashRegistry)), 0644); err != nil {
+		return fmt.Errorf("writing %s: %w", changesPath, err)
+	}
+
+	summaryPath := filepath.Join(paths.snippetsDir, "summary.json")
+	if err := saveRunSummary(summaryPath, stats, out.hashRegistry, duplicates); err != nil {
+		return fmt.Errorf("writing %s: %w", summaryPath, err)
+	}
+
+	if paths.depsDir != "" {
+		indexPath := filepath.Join(paths.depsDir, "index.json")
+		if err := saveDependencyIndex(indexPath, out.depSnippets); err != nil {
+			return fmt.Errorf("writing %s: %w", indexPath, err)
+		}
+	}
+
+	malformedPath := filepath.Join(paths.outputDir, "malformed.md")
+	if err := writeFile(malformedPath, []byte(malformedReport(out.sources)), 0644); err != nil {
+		return fmt.Errorf("writing %s: %w", malformedPath, err)
+	}
+
+	mostCommonPath := filepath.Join(paths.outputDir, "most-common.toml")
+	if err := saveMostCommon(mostCommonPath, p.cfg.owners, dependencyUses, p.cfg.top); err != nil {
+		return fmt.Errorf("writing %s: %w", mostCommonPath, err)
+	}
+	if err := saveByCategory(paths.categoriesDir, p.cfg.owners, dependencyUses, categories, p.cfg.top); err != nil {
+		return fmt.Errorf("writing category snippets: %w", err)
+	}
+
+	if p.cfg.verifyCrates && stats.NotProcessed > 0 {
+		slog.Warn("skipping -verify-crates after an interrupt")
+	} else if p.cfg.verifyCrates {
+		client := newCratesIOClient(p.cfg.cratesIOConcurrency)
+		missingPath := filepath.Join(paths.outputDir, "missing-crates.md")
+		missing := findMissingCrates(client, dependencyUses)
+		if err := writeFile(missingPath, []byte(missingCratesReport(missing)), 0644); err != nil {
+			return fmt.Errorf("writing %s: %w", missingPath, err)
+		}
+
+		yankedPath := filepath.Join(paths.outputDir, "yanked-dependencies.md")
+		yanked := findYankedPins(client, dependencyUses)
+		if err := writeFile(yankedPath, []byte(yankedDependenciesReport(yanked)), 0644); err != nil {
+			return fmt.Errorf("writing %s: %w", yankedPath, err)
+		}
+	}
+
+	if p.cfg.cargoLock {
+		resolvedPath := filepath.Join(paths.outputDir, "resolved-versions.md")
+		if err := writeFile(resolvedPath, []byte(resolvedVersionsReport(dependencyUses, p.resolved)), 0644); err != nil {
+			return fmt.Errorf("writing %s: %w", resolvedPath, err)
+		}
+	}
+	return nil
+}
+
+// firstNonEmpty returns the first of values that is not "".
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// reportDownloadError logs a failed manifest download of repo, at debug
+// level when the repository simply has no such Cargo.toml.
+func reportDownloadError(repo string, err error) {
+	if errors.Is(err, errNotFound) {
+		slog.Debug("skipping repository without manifest", "repo", repo, "err", err)
+		return
+	}
+	slog.Error("download failed", "repo", repo, "err", err)
+}
+
+// newLogger builds the logger selected by -log-level and -log-format.
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid -log-level %q: %w", level, err)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid -log-format %q: want text or json", format)
+}
+
+// manifestResult is one downloaded and parsed Cargo.toml of a repository.
+type manifestResult struct {
+	member        string // directory of a workspace member, "" for the root
+	stem          string
+	cargoTomlPath string
+	branch        string // branch the manifest was downloaded from
+	content       string
+	unchanged     bool
+	sections      map[string]string
+	err           error
+}
+
+// source returns the identifier used in source IDs and headers:
+// "owner/repo" for the root manifest, "owner/repo:dir" for a member.
+func (m manifestResult) source(repo RepoInfo) string {
+	if m.member == "" {
+		return repo.FullName
+	}
+	return repo.FullName + ":" + m.member
+}
+
+// repoResult is the outcome of downloading and parsing one repository. err
+// is set when the root Cargo.toml could not be downloaded, treeErr when the
+// member manifests could not be listed and lockErr when Cargo.lock could not
+// be read.
+type repoResult struct {
+	repo      RepoInfo
+	manifests []manifestResult // root first, then any members
+	locked    []LockedPackage
+	err       error
+	treeErr   error
+	lockErr   error
+}
+
+// fetchOptions controls what processRepo downloads besides the root
+// Cargo.toml.
+type fetchOptions struct {
+	cargoTomlsDir string
+	etags         *ETagCache
+	monorepo      bool // also fetch nested Cargo.toml files
+	members       bool // also fetch the root's [workspace] members
+	lockfile      bool // also fetch and parse Cargo.lock
+}
+
+// processRepo downloads the Cargo.toml files of repoInfo and extracts their
+// dependency sections. With opts.monorepo set, every nested Cargo.toml
+// listed by the Git Trees API is fetched as well; with opts.members only
+// those of the root's [workspace] members. opts.lockfile adds the root
+// Cargo.lock. Everything after the root manifest is read from the branch the
+// root was found on, which need not be repoInfo.DefaultBranch. It writes
+// nothing and is safe to run concurrently.
+func processRepo(repoInfo RepoInfo, stem string, opts fetchOptions) repoResult {
+	result := repoResult{repo: repoInfo}
+
+	root := fetchManifest(repoInfo, repoInfo.DefaultBranch, "", stem, opts.cargoTomlsDir, opts.etags)
+	if root.err != nil {
+		result.err = root.err
+		return result
+	}
+	result.manifests = append(result.manifests, root)
+
+	if opts.lockfile {
+		result.locked, result.lockErr = fetchCargoLock(repoInfo, root.branch)
+	}
+
+	var memberDirs []string
+	switch {
+	case opts.monorepo:
+		paths, err := listCargoTomlPaths(repoInfo.Owner(), repoInfo.Name, root.branch)
+		if err != nil {
+			result.treeErr = err
+			return result
+		}
+		for _, manifestPath := range paths {
+			memberDirs = append(memberDirs, path.Dir(manifestPath))
+		}
+	case opts.members:
+		members, exclude := workspaceMembers(root.content)
+		// The tree is only listed when a glob needs expanding
+		var paths []string
+		for _, member := range members {
+			if !isGlob(member) {
+				continue
+			}
+			var err error
+			if paths, err = listCargoTomlPaths(repoInfo.Owner(), repoInfo.Name, root.branch); err != nil {
+				result.treeErr = err
+				return result
+			}
+			break
+		}
+		memberDirs = expandMembers(members, exclude, paths)
+	}
+	for _, member := range memberDirs {
+		result.manifests = append(result.manifests, fetchManifest(repoInfo, root.branch, member, stem, opts.cargoTomlsDir, opts.etags))
+	}
+	return result
+}
+
+// workspaceMembers returns the members and exclude lists of the [workspace]
+// table of content, cleaned with path.Clean. Parsing stops at the first key
+// that does not parse.
+func workspaceMembers(content string) (members, exclude []string) {
+	body := tableBody(content, "workspace")
+	for rest := cargosnip.SkipSpace(body); rest != ""; rest = cargosnip.SkipSpace(rest) {
+		keys, value, next, err := cargosnip.ParseKeyValue(rest)
+		if err != nil {
+			break
+		}
+		rest = next
+		if len(keys) != 1 || keys[0] != "members" && keys[0] != "exclude" {
+			continue
+		}
+		items, _ := value.([]any)
+		var dirs []string
+		for _, item := range items {
+			if dir, ok := item.(string); ok {
+				dirs = append(dirs, path.Clean(dir))
+			}
+		}
+		if keys[0] == "members" {
+			members = dirs
+		} else {
+			exclude = dirs
+		}
+	}
+	return members, exclude
+}
+
+// expandMembers resolves workspace members to member directories. Globs
+// such as "crates/*" are matched against the directories of paths, the
+// nested Cargo.toml files of the repository; other members are taken as
+// is. Excluded directories, their subdirectories and the root are left out.
+func expandMembers(members, exclude, paths []string) []string {
+	excluded := func(dir string) bool {
+		for _, e := range exclude {
+			if dir == e || strings.HasPrefix(dir, e+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	seen := make(map[string]bool)
+	var dirs []string
+	add := func(dir string) {
+		if dir != "." && !seen[dir] && !excluded(dir) {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, member := range members {
+		if !isGlob(member) {
+			add(member)
+			continue
+		}
+		for _, manifestPath := range paths {
+			if ok, _ := path.Match(member, path.Dir(manifestPath)); ok {
+				add(path.Dir(manifestPath))
+			}
+		}
+	}
+	return dirs
+}
+
+// isGlob reports whether pattern contains glob metacharacters.
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// tableBody returns the lines of the [name] table of content, without its
+// header, or "" when there is none. Subtables such as [name.sub] are not
+// included.
+func tableBody(content, name string) string {
+	var body []string
+	var scanner cargosnip.LineScanner
+	inTable := false
+	for _, line := range strings.Split(content, "\n") {
+		if scanner.AtTopLevel() {
+			if header, ok := cargosnip.ParseTableHeader(line); ok {
+				inTable = !header.IsArray && header.Name() == name
+				continue
+			}
+		}
+		scanner.Scan(line)
+		if inTable {
+			body = append(body, line)
+		}
+	}
+	return strings.Join(body, "\n")
+}
+
+// packageMetadata reads the name, version, edition and rust-version of the
+// [package] table of content. Fields inherited with `field.workspace = true`
+// are taken from the [workspace.package] table of root, the workspace root
+// manifest. It returns nil when none of the fields is set.
+func packageMetadata(content, root string) *PackageMetadata {
+	fields := tomlStringFields(tableBody(content, "package"))
+	var inherited map[string]string
+	var meta PackageMetadata
+	for key, dst := range map[string]*string{
+		"name": &meta.Name, "version": &meta.Version, "edition": &meta.Edition, "rust-version": &meta.RustVersion,
+	} {
+		value, ok := fields[key]
+		if value == "" && ok {
+			if inherited == nil {
+				inherited = tomlStringFields(tableBody(root, "workspace.package"))
+			}
+			value = inherited[key]
+		}
+		*dst = value
+	}
+	if meta == (PackageMetadata{}) {
+		return nil
+	}
+	return &meta
+}
+
+// tomlStringFields returns the string values of the top-level keys of a
+// table body. A key inherited from the workspace, as `key.workspace = true`
+// or `key = { workspace = true }`, is present with an empty value. Values
+// of other types and lines that do not parse are skipped.
+func tomlStringFields(body string) map[string]string {
+	fields := make(map[string]string)
+	var scanner cargosnip.LineScanner
+	for _, line := range strings.Split(body, "\n") {
+		topLevel := scanner.AtTopLevel()
+		scanner.Scan(line)
+		if !topLevel {
+			continue
+		}
+		keys, value, _, err := cargosnip.ParseKeyValue(strings.TrimSpace(line))
+		if err != nil {
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			if len(keys) == 1 {
+				fields[keys[0]] = v
+			}
+		case bool:
+			if len(keys) == 2 && keys[1] == "workspace" && v {
+				fields[keys[0]] = ""
+			}
+		case map[string]any:
+			if len(keys) == 1 && v["workspace"] == true {
+				fields[keys[0]] = ""
+			}
+		}
+	}
+	return fields
+}
+
+// LockedPackage is one [[package]] entry of a Cargo.lock.
+type LockedPackage struct {
+	Name    string
+	Version string
+}
+
+// fetchCargoLock downloads and parses the root Cargo.lock of repoInfo from
+// branch. Lockfiles are not cached, so no ETag is sent.
+func fetchCargoLock(repoInfo RepoInfo, branch string) ([]LockedPackage, error) {
+	content, _, _, err := downloadCargoToml(repoInfo.Owner(), repoInfo.Name, branch, "Cargo.lock", nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return parseCargoLock(content), nil
+}
+
+// parseCargoLock returns the name and version of every [[package]] in a
+// Cargo.lock. Other tables and malformed lines are ignored.
+func parseCargoLock(content string) []LockedPackage {
+	var packages []LockedPackage
+	var current *LockedPackage
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if header, ok := cargosnip.ParseTableHeader(line); ok {
+			current = nil
+			if header.IsArray && header.Name() == "package" {
+				packages = append(packages, LockedPackage{})
+				current = &packages[len(packages)-1]
+			}
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		keys, value, _, err := cargosnip.ParseKeyValue(line)
+		if err != nil || len(keys) != 1 {
+			continue
+		}
+		if str, ok := value.(string); ok {
+			switch keys[0] {
+			case "name":
+				current.Name = str
+			case "version":
+				current.Version = str
+			}
+		}
+	}
+	return packages
+}
+
+// fetchManifest downloads and parses the Cargo.toml in directory member of
+// repoInfo ("" for the root), trying branch before the -branches fallbacks.
+func fetchManifest(repoInfo RepoInfo, branch, member, stem, cargoTomlsDir string, etags *ETagCache) manifestResult {
+	m := manifestResult{member: member, stem: stem}
+	manifestPath := "Cargo.toml"
+	if member != "" {
+		m.stem = stem + "_" + safeSectionName(member)
+		manifestPath = member + "/Cargo.toml"
+	}
+	m.cargoTomlPath = filepath.Join(cargoTomlsDir, fmt.Sprintf("%s_Cargo.toml", m.stem))
+
+	content, usedBranch, unchanged, err := downloadCargoToml(repoInfo.Owner(), repoInfo.Name, branch, manifestPath, etags, m.cargoTomlPath)
+	if err != nil {
+		m.err = err
+		return m
+	}
+	m.branch = usedBranch
+
+	m.content = skipLeadingJunk(m.source(repoInfo), content)
+	m.unchanged = unchanged
+	if !unchanged {
+		// A re-downloaded but byte-identical file counts as unchanged too
+		if cached, err := readCachedCargoToml(m.cargoTomlPath); err == nil && cargosnip.NormalizeLineEndings(cached) == m.content {
+			m.unchanged = true
+		}
+	}
+	m.sections = extractDependencySections(m.content)
+	return m
+}
+
+// gitTreeResponse is the subset of the Git Trees API response we use.
+type gitTreeResponse struct {
+	Tree []struct {
+		Path string `json:"path"`
+		Type string `json:"type"`
+	} `json:"tree"`
+	Truncated bool `json:"truncated"`
+}
+
+// listCargoTomlPaths returns the paths of all nested Cargo.toml files in
+// repo at branch, excluding the root manifest.
+func listCargoTomlPaths(owner, repo, branch string) ([]string, error) {
+	url := fmt.Sprintf("%s/repos/%s/%s/git/trees/%s?recursive=1", apiBase, owner, repo, branch)
+
+	req, err := newGitHubRequest(url)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	logRateLimit(fmt.Sprintf("tree listing for %s", repo), resp)
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, errUnauthorized
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GitHub API error: %d", resp.StatusCode)
+	}
+
+	var tree gitTreeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tree); err != nil {
+		return nil, fmt.Errorf("failed to decode tree: %w", err)
+	}
+	if tree.Truncated {
+		slog.Warn("tree listing truncated; some Cargo.toml files may be missed", "repo", repo)
+	}
+
+	var paths []string
+	for _, entry := range tree.Tree {
+		if entry.Type == "blob" && strings.HasSuffix(entry.Path, "/Cargo.toml") {
+			paths = append(paths, entry.Path)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// fetchRepos runs process over repos with at most concurrency workers and
+// returns the results in the same order as repos. Each completed repository
+// is reported to progress, if non-nil. Once stop is closed no new repository
+// is started; those already in flight finish, and only the repositories
+// that were processed are returned.
+func fetchRepos(repos []RepoInfo, concurrency int, progress *progressReporter, stop <-chan struct{}, process func(RepoInfo) repoResult) []repoResult {
+	type indexedResult struct {
+		index  int
+		result repoResult
+	}
+
+	jobs := make(chan int)
+	out := make(chan indexedResult)
+
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				out <- indexedResult{index: i, result: process(repos[i])}
+			}
+		}()
+	}
+
+	go func() {
+	feed:
+		for i := range repos {
+			select {
+			case jobs <- i:
+			case <-stop:
+				break feed
+			}
+		}
+		close(jobs)
+		wg.Wait()
+		close(out)
+	}()
+
+	// Results are collected on this goroutine only, so progress needs no
+	// locking
+	results := make([]repoResult, len(repos))
+	done := make([]bool, len(repos))
+	for r := range out {
+		results[r.index] = r.result
+		done[r.index] = true
+		progress.completed(r.result.repo)
+	}
+	progress.finish()
+
+	processed := results[:0]
+	for i, result := range results {
+		if done[i] {
+			processed = append(processed, result)
+		}
+	}
+	return processed
+}
+
+// interruptChannel returns a channel that is closed on the first SIGINT or
+// SIGTERM. Later signals get the default behavior again, so a second Ctrl-C
+// still kills the process at once.
+func interruptChannel() <-chan struct{} {
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		signal.Reset(os.Interrupt, syscall.SIGTERM)
+		slog.Warn("interrupted; finishing in-flight downloads and writing partial results", "signal", sig)
+		close(stop)
+	}()
+	return stop
+}
+
+// progressReporter shows how many repositories have been fetched. On a
+// terminal it redraws a single "[done/total] repo" line; otherwise it logs
+// at every progressStep percent so CI output is not flooded.
+type progressReporter struct {
+	total       int
+	done        int
+	tty         bool
+	lastPercent int
+}
+
+// progressStep is the percentage interval of non-terminal progress logs.
+const progressStep = 10
+
+func newProgressReporter(total int) *progressReporter {
+	return &progressReporter{total: total, tty: isTerminal(os.Stdout)}
+}
+
+// isTerminal reports whether f is a character device such as a TTY.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// completed records that repo has been fetched.
+func (p *progressReporter) completed(repo RepoInfo) {
+	if p == nil || p.total == 0 {
+		return
+	}
+	p.done++
+	if p.tty {
+		fmt.Printf("\r\033[K[%d/%d] Processed %s", p.done, p.total, repo.FullName)
+		return
+	}
+	if percent := p.done * 100 / p.total; percent >= p.lastPercent+progressStep || p.done == p.total {
+		p.lastPercent = percent - percent%progressStep
+		slog.Info("progress", "done", p.done, "total", p.total, "percent", percent)
+	}
+}
+
+// finish ends the terminal progress line.
+func (p *progressReporter) finish() {
+	if p != nil && p.tty && p.done > 0 {
+		fmt.Println()
+	}
+}
+
+// runOutput holds the output directories and the state accumulated while
+// snippets are saved during one run.
+type runOutput struct {
+	outputDir      string
+	groupedDir     string
+	hashDir        string
+	stats          *Stats
+	hashRegistry   HashRegistry
+	snippetIndex   SnippetIndex
+	dependencyUses []DependencyUse
+	sources        map[string]*ManifestSource
+
+	// depsDir receives one snippet per dependency entry when
+	// -dep-level-dedup is set; depSnippets indexes them by crate and file.
+	depsDir     string
+	depSnippets map[string]map[string]*DependencySnippet
+}
+
+// source returns the ManifestSource being built for source.
+func (out *runOutput) source(source, repo string) *ManifestSource {
+	ms := out.sources[source]
+	if ms == nil {
+		ms = &ManifestSource{Source: source, Repo: repo}
+		out.sources[source] = ms
+	}
+	return ms
+}
+
+// saveSections saves the full and grouped snippets of one manifest's
+// sections. repo is the "owner/name" of the repository and source the
+// manifest's identifier in source IDs (see manifestResult.source). Failed
+// writes do not stop the remaining snippets; they are returned joined.
+// workspace holds the root manifest's [workspace.dependencies], against which
+// inherited entries are resolved.
+func (out *runOutput) saveSections(stem, repo, source string, sections map[string]string, workspace map[string]cargosnip.Dependency) error {
+	var errs []error
+	record := out.source(source, repo)
+	features := featureReferences(sections[cargosnip.FeaturesSection])
+	for _, sectionName := range sortedSectionNames(sections) {
+		sectionContent := sections[sectionName]
+		// Save the full section, noting which features enable its optional
+		// dependencies and what its inherited dependencies resolve to
+		var notes string
+		if cargosnip.DeclaresDependencies(sectionName) {
+			notes = optionalDependencyNotes(sectionContent, features) + workspaceInheritanceNotes(sectionContent, workspace)
+		}
+		snippetFile, snippetText, err := saveSnippet(out.outputDir, stem, record.ref(), sectionName, sectionContent, notes)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			slog.Debug("saved section", "repo", source, "section", sectionName, "file", snippetFile)
+			out.stats.addSnippetSize(snippetFile, source, snippetText)
+			record.Files = append(record.Files, filepath.Join(out.outputDir, snippetFile))
+			if err := out.saveCargoAddScript(record, filepath.Join(out.outputDir, strings.TrimSuffix(snippetFile, ".toml")+".sh"), sectionName, sectionEntries(sectionContent)); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		out.stats.SectionsExtracted++
+		record.Sections = append(record.Sections, sectionName)
+
+		// Split by blank lines and save grouped snippets with hash-based dedup
+		groups := cargosnip.SplitByBlankLines(sectionContent)
+		if cargosnip.DeclaresDependencies(sectionName) {
+			uses := collectDependencyUses(repo, sectionName, groups, workspace)
+			for _, decls := range duplicateDeclarations(uses) {
+				slog.Warn("crate declared more than once in a section", "repo", source,
+					"section", sectionName, "crate", decls[0].Name, "declarations", len(decls))
+			}
+			out.dependencyUses = append(out.dependencyUses, uses...)
+			record.Dependencies = append(record.Dependencies, uses...)
+		}
+		groups = annotateInheritedGroups(portableGroups(groups, out.stats), workspace)
+		if out.depsDir != "" && cargosnip.DeclaresDependencies(sectionName) {
+			if err := out.saveDependencySnippets(record, sectionName, groups); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		for i, group := range groups {
+			symlinkPath, contentHash, err := saveGroupedSnippet(
+				out.groupedDir, out.hashDir, stem, source, sectionName, i+1, group, out.hashRegistry, out.snippetIndex,
+			)
+			out.stats.GroupsExtracted++
+			record.Groups = append(record.Groups, ManifestGroup{Section: sectionName, Index: i + 1, ShortHash: contentHash})
+			if symlinkPath != "" {
+				record.Files = append(record.Files, symlinkPath)
+			}
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			slog.Debug("saved group", "repo", source, "section", sectionName, "group", i+1,
+				"file", filepath.Base(symlinkPath), "hash", contentHash)
+			body := renderSnippet(group)
+			out.stats.GroupedBytes += int64(len(body))
+			if len(out.hashRegistry[contentHash]) == 1 {
+				out.stats.HashedBytes += int64(len(body))
+				out.stats.addSnippetSize(contentHash+snippetExt(), source, body)
+			}
+			if err := out.saveCargoAddScript(record, strings.TrimSuffix(symlinkPath, snippetExt())+".sh", sectionName, cargosnip.SplitEntries(group)); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// saveCombinedSnippet writes {stem}_all.toml: every section of sections, in
+// the manifest order given by order, under one header.
+func (out *runOutput) saveCombinedSnippet(record *ManifestSource, stem string, sections map[string]string, order []string) error {
+	var names, bodies []string
+	for _, name := range order {
+		if content, ok := sections[name]; ok {
+			names = append(names, "["+name+"]")
+			bodies = append(bodies, strings.TrimRight(content, "\n"))
+		}
+	}
+	if len(bodies) == 0 {
+		return nil
+	}
+
+	path := filepath.Join(out.outputDir, stem+"_all.toml")
+	content := fmt.Sprintf("# Source: %s\n# Sections: %s\n# Auto-generated - do not edit\n\n%s\n",
+		record.ref(), strings.Join(names, ", "), strings.Join(bodies, "\n\n"))
+	if err := writeFile(path, []byte(content), 0644); err != nil {
+		return fmt.Errorf("saving combined snippet: %w", err)
+	}
+	record.Files = append(record.Files, path)
+	return nil
+}
+
+// saveCargoAddScript writes, with -cargo-add, the `cargo add` commands for
+// entries, a section or group of record, to scriptPath. Sections that cargo
+// add cannot edit are skipped.
+func (out *runOutput) saveCargoAddScript(record *ManifestSource, scriptPath, sectionName string, entries []cargosnip.Entry) error {
+	if !cargoAddScripts {
+		return nil
+	}
+	sectionFlags, ok := cargoAddSectionFlags(sectionName)
+	if !ok {
+		return nil
+	}
+	if err := writeFile(scriptPath, []byte(cargoAddScript(record.ref(), sectionName, entries, sectionFlags)), 0755); err != nil {
+		return fmt.Errorf("saving cargo add script: %w", err)
+	}
+	record.Files = append(record.Files, scriptPath)
+	return nil
+}
+
+// reuseSource carries prev, a source recorded by an earlier run, into this
+// run without touching its files: its groups are re-registered under their
+// old hashes and its dependencies re-counted. snippets holds the previous
+// manifest's entries by short hash, with absolute paths.
+func (out *runOutput) reuseSource(prev ManifestSource, snippets map[string]ManifestEntry) {
+	record := out.source(prev.Source, prev.Repo)
+	record.Branch = prev.Branch
+	record.Package = prev.Package
+	record.Sections = append(record.Sections, prev.Sections...)
+	record.Files = append(record.Files, prev.Files...)
+	record.Groups = append(record.Groups, prev.Groups...)
+	record.Dependencies = append(record.Dependencies, prev.Dependencies...)
+	out.dependencyUses = append(out.dependencyUses, prev.Dependencies...)
+	if out.depsDir != "" {
+		for _, ref := range prev.DependencySnippets {
+			out.recordDependencySnippet(record, ref)
+		}
+	}
+
+	for _, group := range prev.Groups {
+		entry := snippets[group.ShortHash]
+		sourceID := groupSourceID(prev.Source, group.Section, group.Index)
+		out.hashRegistry[group.ShortHash] = appendUnique(out.hashRegistry[group.ShortHash], sourceID)
+		out.snippetIndex.record(group.ShortHash, entry.Hash, entry.Path, group.Section)
+		out.stats.GroupsExtracted++
+	}
+	out.stats.SectionsExtracted += len(prev.Sections)
+}
+
+// saveDependencySnippets saves each entry of groups, the portable groups of
+// one section, as its own snippet under depsDir. Entries are hashed like
+// groups, so equal declarations of a crate share a file across sources.
+func (out *runOutput) saveDependencySnippets(record *ManifestSource, sectionName string, groups []string) error {
+	var errs []error
+	for _, group := range groups {
+		for _, entry := range cargosnip.SplitEntries(group) {
+			if entry.Name == "" {
+				continue
+			}
+			content := strings.Join(trimCommentLines(entry.Raw), "\n")
+			ref := ManifestDependencySnippet{
+				Section:   sectionName,
+				Crate:     entry.Name,
+				ShortHash: cargosnip.ComputeContentHash(content)[:16],
+			}
+			if dep, err := entry.Dependency(); err == nil {
+				ref.Comments = dep.Comments
+			}
+			if out.depSnippets[ref.Crate][ref.fileName()] == nil {
+				path := filepath.Join(out.depsDir, ref.fileName())
+				if err := writeFile(path, []byte(content+"\n"), 0644); err != nil {
+					errs = append(errs, fmt.Errorf("saving dependency snippet: %w", err))
+					continue
+				}
+			}
+			out.recordDependencySnippet(record, ref)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// recordDependencySnippet adds ref, declared by record, to the per-crate
+// index.
+func (out *runOutput) recordDependencySnippet(record *ManifestSource, ref ManifestDependencySnippet) {
+	record.DependencySnippets = append(record.DependencySnippets, ref)
+	byFile := out.depSnippets[ref.Crate]
+	if byFile == nil {
+		byFile = make(map[string]*DependencySnippet)
+		out.depSnippets[ref.Crate] = byFile
+	}
+	snippet := byFile[ref.fileName()]
+	if snippet == nil {
+		snippet = &DependencySnippet{ShortHash: ref.ShortHash, Path: ref.fileName()}
+		byFile[ref.fileName()] = snippet
+	}
+	snippet.Sources = appendUnique(snippet.Sources, record.Source+"/"+safeSectionName(ref.Section))
+	snippet.Sections = appendUnique(snippet.Sections, ref.Section)
+	for _, comment := range ref.Comments {
+		snippet.Comments = appendUnique(snippet.Comments, comment)
+	}
+}
+
+// appendUnique appends value to list unless it is already present.
+func appendUnique(list []string, value string) []string {
+	for _, v := range list {
+		if v == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
+
+// trimCommentLines drops the blank and comment lines before and after an
+// entry's declaration.
+func trimCommentLines(lines []string) []string {
+	for len(lines) > 0 && isCommentOrBlank(lines[0]) {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && isCommentOrBlank(lines[len(lines)-1]) {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// isCommentOrBlank reports whether line is empty or only a comment.
+func isCommentOrBlank(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return trimmed == "" || strings.HasPrefix(trimmed, "#")
+}
+
+// sortedSectionNames returns the names of sections in sorted order, so that
+// sources are registered in the same order on every run.
+func sortedSectionNames(sections map[string]string) []string {
+	names := make([]string, 0, len(sections))
+	for name := range sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// countSections tallies the sections, groups and hashes that sections would
+// produce, registering group hashes without assembling or writing any files.
+// source is the manifest identifier used in source IDs and workspace the
+// root manifest's [workspace.dependencies].
+func countSections(source string, sections map[string]string, workspace map[string]cargosnip.Dependency, stats *Stats, hashRegistry HashRegistry) {
+	for _, sectionName := range sortedSectionNames(sections) {
+		sectionContent := sections[sectionName]
+		stats.SectionsExtracted++
+		for i, group := range annotateInheritedGroups(portableGroups(cargosnip.SplitByBlankLines(sectionContent), stats), workspace) {
+			shortHash := cargosnip.ComputeContentHash(group)[:16]
+			hashRegistry[shortHash] = appendUnique(hashRegistry[shortHash], groupSourceID(source, sectionName, i+1))
+			stats.GroupsExtracted++
+		}
+	}
+}
+
+// discoverRustRepos lists the Rust repositories of owner that pass filter,
+// along with how many results were filtered out. Repositories are found with
+// the search API; when it reports more matches than searchResultCap, all of
+// the owner's repositories are listed instead and filtered by language.
+// owner may be a user or an organization.
+func discoverRustRepos(owner string, perPage int, filter DiscoveryFilter) ([]RepoInfo, SkipCounts, error) {
+	slog.Info("discovering Rust repositories", "owner", owner)
+
+	accountType, err := ownerAccountType(owner)
+	if err != nil {
+		return nil, SkipCounts{}, err
+	}
+
+	found, total, err := searchRustRepos(owner, accountType, perPage)
+	if err != nil {
+		return nil, SkipCounts{}, err
+	}
+	if total > searchResultCap {
+		slog.Warn("search results exceed the search API cap; listing all of the owner's repositories instead",
+			"owner", owner, "total_count", total, "cap", searchResultCap)
+		found, err = listRustRepos(owner, accountType, perPage, filter.IncludeForks)
+		if err != nil {
+			return nil, SkipCounts{}, err
+		}
+	}
+
+	var repos []RepoInfo
+	var skipped SkipCounts
+	for _, repoInfo := range found {
+		if repoInfo.Archived && !filter.IncludeArchived {
+			skipped.Archived++
+			continue
+		}
+		if repoInfo.Fork && !filter.IncludeForks {
+			skipped.Forks++
+			continue
+		}
+		if !filter.PushedSince.IsZero() && repoInfo.PushedAt.Before(filter.PushedSince) {
+			skipped.Stale = append(skipped.Stale, repoInfo)
+			continue
+		}
+		repos = append(repos, repoInfo)
+	}
+
+	if len(repos) == 0 && len(skipped.Stale) == 0 {
+		return nil, skipped, fmt.Errorf("no repositories found via GitHub API")
+	}
+
+	slog.Info("found Rust repositories", "owner", owner, "repos", len(repos),
+		"skipped_archived", skipped.Archived, "skipped_forks", skipped.Forks, "skipped_stale", len(skipped.Stale))
+	return repos, skipped, nil
+}
+
+// userAccount is the GitHub account type of users, as opposed to
+// "Organization".
+const userAccount = "User"
+
+// ownerAccountType returns the account type GitHub reports for owner, "User"
+// or "Organization". The search qualifier and the repository listing
+// endpoint both depend on it.
+func ownerAccountType(owner string) (string, error) {
+	var account struct {
+		Type string `json:"type"`
+	}
+	if _, err := getGitHubPage(fmt.Sprintf("%s/users/%s", apiBase, owner), "account lookup", &account); err != nil {
+		return "", fmt.Errorf("looking up account %s: %w", owner, err)
+	}
+	return account.Type, nil
+}
+
+// searchRustRepos returns the search API results for the Rust repositories
+// of owner and the total_count the search reported. When total exceeds
+// searchResultCap it stops after the first page, since the rest would be
+// truncated anyway.
+func searchRustRepos(owner, accountType string, perPage int) (repos []RepoInfo, total int, err error) {
+	qualifier := "org"
+	if accountType == userAccount {
+		qualifier = "user"
+	}
+	url := fmt.Sprintf("%s/search/repositories?q=%s:%s+language:Rust&per_page=%d&page=1",
+		apiBase, qualifier, owner, perPage)
+
+	for page := 1; url != ""; page++ {
+		var searchResp GitHubSearchResponse
+		url, err = getGitHubPage(url, fmt.Sprintf("discovery page %d", page), &searchResp)
+		if err != nil {
+			return nil, 0, err
+		}
+		if page == 1 {
+			total = searchResp.TotalCount
+			if total > searchResultCap {
+				return nil, total, nil
+			}
+		}
+		repos = append(repos, searchResp.Items...)
+	}
+	return repos, total, nil
+}
+
+// listRustRepos pages through every repository of owner, which is not
+// subject to the search cap, and keeps those whose primary language is Rust.
+// For organizations forks are only listed when includeForks is set; the user
+// listing has no such filter, so a user's forks are left to the caller.
+func listRustRepos(owner, accountType string, perPage int, includeForks bool) ([]RepoInfo, error) {
+	var url string
+	if accountType == userAccount {
+		url = fmt.Sprintf("%s/users/%s/repos?type=owner&per_page=%d&page=1", apiBase, owner, perPage)
+	} else {
+		repoType := "sources"
+		if includeForks {
+			repoType = "all"
+		}
+		url = fmt.Sprintf("%s/orgs/%s/repos?type=%s&per_page=%d&page=1", apiBase, owner, repoType, perPage)
+	}
+
+	var repos []RepoInfo
+	for page := 1; url != ""; page++ {
+		var listed []RepoInfo
+		var err error
+		url, err = getGitHubPage(url, fmt.Sprintf("repository listing page %d", page), &listed)
+		if err != nil {
+			return nil, err
+		}
+		for _, repoInfo := range listed {
+			if repoInfo.Language == "Rust" {
+				repos = append(repos, repoInfo)
+			}
+		}
+	}
+	return repos, nil
+}
+
+// getGitHubPage decodes the JSON response of the GitHub API page at url into
+// v and returns the URL of the next page, or "" on the last one. label names
+// the request in rate limit logs.
+func getGitHubPage(url, label string, v any) (string, error) {
+	req, err := newGitHubRequest(url)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch repositories: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return "", errUnauthorized
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GitHub API error: %d", resp.StatusCode)
+	}
+
+	logRateLimit(label, resp)
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return "", fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nextPageURL(resp.Header.Get("Link")), nil
+}
+
+// loadReposFile reads the repositories listed in path, one
+// "owner/repo" or "owner/repo@branch" per line. Blank lines and lines
+// starting with # are ignored, as are repeated entries. Without a branch,
+// "main" is tried first, with downloadCargoToml falling back to the other
+// -branches.
+func loadReposFile(path string) ([]RepoInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading repos file: %w", err)
+	}
+
+	var repos []RepoInfo
+	seen := make(map[string]bool)
+	for i, line := range strings.Split(cargosnip.NormalizeLineEndings(string(data)), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		repo, err := parseRepoSpec(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+		if seen[repo.FullName] {
+			continue
+		}
+		seen[repo.FullName] = true
+		repos = append(repos, repo)
+	}
+	return repos, nil
+}
+
+// parseRepoSpec parses "owner/repo" or "owner/repo@branch". Without a
+// branch, "main" is used.
+func parseRepoSpec(spec string) (RepoInfo, error) {
+	fullName, branch, _ := strings.Cut(spec, "@")
+	owner, name, ok := strings.Cut(fullName, "/")
+	if !ok || owner == "" || name == "" || strings.Contains(name, "/") {
+		return RepoInfo{}, fmt.Errorf("want owner/repo or owner/repo@branch, got %q", spec)
+	}
+	if branch == "" {
+		branch = "main"
+	}
+	return RepoInfo{Name: name, DefaultBranch: branch, FullName: fullName}, nil
+}
+
+// crateFilter selects the crates listed in the aggregate reports from
+// -allow-crates and -block-crates, path.Match globs against the crates.io
+// name of each dependency. A crate is listed when it matches an allow
+// pattern, or none are given, and matches no block pattern: a crate matched
+// by both is left out.
+type crateFilter struct {
+	allow stringList
+	block stringList
+}
+
+// validate reports the first malformed pattern.
+func (f crateFilter) validate() error {
+	for _, pattern := range append(append([]string(nil), f.allow...), f.block...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid crate pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// allows reports whether crate is listed in the reports.
+func (f crateFilter) allows(crate string) bool {
+	matches := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, crate); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return (len(f.allow) == 0 || matches(f.allow)) && !matches(f.block)
+}
+
+// filter returns the uses of allowed crates, or uses itself when there are
+// no patterns.
+func (f crateFilter) filter(uses []DependencyUse) []DependencyUse {
+	if len(f.allow) == 0 && len(f.block) == 0 {
+		return uses
+	}
+	var kept []DependencyUse
+	for _, use := range uses {
+		if f.allows(use.crate()) {
+			kept = append(kept, use)
+		}
+	}
+	return kept
+}
+
+// defaultCategories are the built-in crate categories of by-category/.
+var defaultCategories = map[string][]string{
+	"async":   {"tokio", "futures", "futures-util", "async-trait", "async-std", "async-channel", "pin-project", "pin-project-lite"},
+	"cli":     {"clap", "argh", "structopt", "indicatif", "dialoguer"},
+	"errors":  {"anyhow", "thiserror", "eyre", "color-eyre", "miette"},
+	"logging": {"log", "tracing", "tracing-subscriber", "env_logger"},
+	"serde":   {"serde", "serde_json", "serde_yaml", "serde_bytes", "toml", "bincode", "postcard", "ciborium"},
+	"wasm":    {"wasm-bindgen", "wasm-bindgen-futures", "js-sys", "web-sys", "wasmparser", "wasm-encoder", "walrus"},
+	"web":     {"axum", "hyper", "reqwest", "http", "tower", "tower-http", "actix-web", "warp"},
+}
+
+// defaultCategoryOf maps each crate of defaultCategories to its category.
+var defaultCategoryOf = func() map[string]string {
+	m := make(map[string]string)
+	for category, crates := range defaultCategories {
+		for _, crate := range crates {
+			m[crate] = category
+		}
+	}
+	return m
+}()
+
+// crateCategories assigns crates to the categories of by-category/.
+// Patterns from a -categories-file are tried in file order before
+// defaultCategories.
+type crateCategories struct {
+	patterns []categoryPattern
+}
+
+// categoryPattern is one crate glob of a -categories-file line.
+type categoryPattern struct {
+	crate, category string
+}
+
+// loadCategories reads a -categories-file. Each line is
+// "category: crate, glob*"; blank lines and lines starting with # are
+// ignored.
+func loadCategories(file string) (crateCategories, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return crateCategories{}, fmt.Errorf("reading categories file: %w", err)
+	}
+
+	var categories crateCategories
+	for i, line := range strings.Split(cargosnip.NormalizeLineEndings(string(data)), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		category, crates, ok := strings.Cut(line, ":")
+		category = strings.TrimSpace(category)
+		if !ok || category == "" {
+			return crateCategories{}, fmt.Errorf("%s:%d: want \"category: crate, ...\", got %q", file, i+1, line)
+		}
+		for _, crate := range strings.Split(crates, ",") {
+			crate = strings.TrimSpace(crate)
+			if crate == "" {
+				continue
+			}
+			if _, err := path.Match(crate, ""); err != nil {
+				return crateCategories{}, fmt.Errorf("%s:%d: invalid pattern %q: %w", file, i+1, crate, err)
+			}
+			categories.patterns = append(categories.patterns, categoryPattern{crate: crate, category: category})
+		}
+	}
+	slog.Debug("loaded categories file", "path", file, "patterns", len(categories.patterns))
+	return categories, nil
+}
+
+// category returns the category of crate, or "" when it has none.
+func (c crateCategories) category(crate string) string {
+	for _, p := range c.patterns {
+		if ok, _ := path.Match(p.crate, crate); ok {
+			return p.category
+		}
+	}
+	return defaultCategoryOf[crate]
+}
+
+// snippetIgnore holds the patterns of a .snippetignore file. Each line is a
+// path.Match glob against "owner/repo", skipping matching repositories
+// entirely, or "owner/repo:section", whose matching sections are extracted
+// but not saved.
+type snippetIgnore struct {
+	repos    []string
+	sections []sectionPattern
+}
+
+// sectionPattern is an "owner/repo:section" line of a .snippetignore file.
+type sectionPattern struct {
+	repo, section string
+}
+
+// loadSnippetIgnore reads the .snippetignore file named file. Blank lines and
+// lines starting with # are ignored; a missing file ignores nothing.
+func loadSnippetIgnore(file string) (*snippetIgnore, error) {
+	ignore := &snippetIgnore{}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return ignore, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", file, err)
+	}
+
+	for i, line := range strings.Split(cargosnip.NormalizeLineEndings(string(data)), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		repo, section, hasSection := strings.Cut(line, ":")
+		for _, pattern := range []string{repo, section} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid pattern %q: %w", file, i+1, line, err)
+			}
+		}
+		if hasSection {
+			ignore.sections = append(ignore.sections, sectionPattern{repo: repo, section: section})
+		} else {
+			ignore.repos = append(ignore.repos, repo)
+		}
+	}
+	slog.Debug("loaded .snippetignore", "path", file, "repos", len(ignore.repos), "sections", len(ignore.sections))
+	return ignore, nil
+}
+
+// filterRepos drops the repositories matching a repository pattern and
+// returns how many were dropped.
+func (ig *snippetIgnore) filterRepos(repos []RepoInfo) ([]RepoInfo, int) {
+	var kept []RepoInfo
+	for _, repo := range repos {
+		if ig.ignoresRepo(repo.FullName) {
+			slog.Debug("ignoring repository", "repo", repo.FullName)
+			continue
+		}
+		kept = append(kept, repo)
+	}
+	return kept, len(repos) - len(kept)
+}
+
+func (ig *snippetIgnore) ignoresRepo(fullName string) bool {
+	for _, pattern := range ig.repos {
+		if ok, _ := path.Match(pattern, fullName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// filterSections returns sections without those of repo that match a
+// section pattern, counting them in stats. sections is returned as is when
+// nothing matches.
+func (ig *snippetIgnore) filterSections(repo string, sections map[string]string, stats *Stats) map[string]string {
+	var kept map[string]string
+	for name := range sections {
+		for _, pattern := range ig.sections {
+			repoOK, _ := path.Match(pattern.repo, repo)
+			sectionOK, _ := path.Match(pattern.section, name)
+			if !repoOK || !sectionOK {
+				continue
+			}
+			if kept == nil {
+				kept = make(map[string]string, len(sections))
+				for k, v := range sections {
+					kept[k] = v
+				}
+			}
+			delete(kept, name)
+			stats.IgnoredSections++
+			slog.Debug("ignoring section", "repo", repo, "section", name)
+			break
+		}
+	}
+	if kept == nil {
+		return sections
+	}
+	return kept
+}
+
+// localOwner is the owner of the pseudo-repositories found by -local.
+const localOwner = "local"
+
+// findLocalRepos walks dir for Cargo.toml files and returns one
+// pseudo-repository per manifest, owned by localOwner and named after the
+// manifest's directory relative to dir (the base name of dir for a root
+// manifest). manifests maps each full name to its Cargo.toml. Hidden
+// directories and target/ build outputs are skipped.
+func findLocalRepos(dir string) (repos []RepoInfo, manifests map[string]string, err error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifests = make(map[string]string)
+	err = filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != root && (strings.HasPrefix(d.Name(), ".") || d.Name() == "target") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Name() != "Cargo.toml" {
+			return nil
+		}
+		rel, err := filepath.Rel(root, filepath.Dir(p))
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			rel = filepath.Base(root)
+		}
+		name := safeSectionName(filepath.ToSlash(rel))
+		fullName := localOwner + "/" + name
+		if _, dup := manifests[fullName]; dup {
+			slog.Warn("skipping local manifest with a duplicate pseudo-repository name", "path", p, "repo", fullName)
+			return nil
+		}
+		manifests[fullName] = p
+		repos = append(repos, RepoInfo{Name: name, FullName: fullName})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("scanning %s: %w", dir, err)
+	}
+	slog.Info("found local Cargo.toml files", "dir", root, "repos", len(repos))
+	return repos, manifests, nil
+}
+
+// processLocalRepo is processRepo for a -local pseudo-repository whose
+// manifest is the file at manifestPath. A Cargo.lock next to it is read
+// when opts.lockfile is set.
+func processLocalRepo(repoInfo RepoInfo, stem, manifestPath string, opts fetchOptions) repoResult {
+	result := repoResult{repo: repoInfo}
+	m := manifestResult{stem: stem, cargoTomlPath: filepath.Join(opts.cargoTomlsDir, fmt.Sprintf("%s_Cargo.toml", stem))}
+
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	m.content = skipLeadingJunk(m.source(repoInfo), cargosnip.NormalizeLineEndings(cargosnip.StripBOM(string(data))))
+	if cached, err := readCachedCargoToml(m.cargoTomlPath); err == nil && cargosnip.NormalizeLineEndings(cached) == m.content {
+		m.unchanged = true
+	}
+	m.sections = extractDependencySections(m.content)
+	result.manifests = append(result.manifests, m)
+
+	if opts.lockfile {
+		lockPath := filepath.Join(filepath.Dir(manifestPath), "Cargo.lock")
+		if lock, err := os.ReadFile(lockPath); err == nil {
+			result.locked = parseCargoLock(cargosnip.NormalizeLineEndings(string(lock)))
+		} else if !os.IsNotExist(err) {
+			result.lockErr = err
+		}
+	}
+	return result
+}
+
+// repoStem is the file name prefix of repo's outputs. File names only carry
+// the owner when several owners are scanned, keeping single-owner output
+// names unchanged.
+func repoStem(repo RepoInfo, multiOwner bool) string {
+	if multiOwner {
+		return repo.Owner() + "_" + repo.Name
+	}
+	return repo.Name
+}
+
+// seenRepoNames returns the set of full names in repos.
+func seenRepoNames(repos []RepoInfo) map[string]bool {
+	names := make(map[string]bool, len(repos))
+	for _, repo := range repos {
+		names[repo.FullName] = true
+	}
+	return names
+}
+
+// reposOwners returns the distinct owners of repos in first-seen order.
+func reposOwners(repos []RepoInfo) stringList {
+	var owners stringList
+	seen := make(map[string]bool)
+	for _, repo := range repos {
+		if owner := repo.Owner(); !seen[owner] {
+			seen[owner] = true
+			owners = append(owners, owner)
+		}
+	}
+	return owners
+}
+
+// nextPageURL returns the rel="next" target of a GitHub Link header, or ""
+// when there is no further page.
+func nextPageURL(linkHeader string) string {
+	for _, link := range strings.Split(linkHeader, ",") {
+		parts := strings.Split(link, ";")
+		if len(parts) < 2 {
+			continue
+		}
+		for _, param := range parts[1:] {
+			if strings.TrimSpace(param) == `rel="next"` {
+				target := strings.TrimSpace(parts[0])
+				return strings.TrimSuffix(strings.TrimPrefix(target, "<"), ">")
+			}
+		}
+	}
+	return ""
+}
+
+// defaultUserAgent identifies the tool, with a contact URL as GitHub and
+// crates.io ask for.
+const defaultUserAgent = "rice-snippets-downloader (https://github.com/portal-co/rice-snippets)"
+
+// userAgent is sent with every HTTP request. Set with -user-agent.
+var userAgent = defaultUserAgent
+
+// newGitHubRequest builds a GET request carrying the tool's User-Agent and,
+// when a token is configured, an Authorization header. Accept-Encoding is
+// deliberately left unset: net/http then asks for gzip itself and
+// decompresses the body transparently, which it stops doing as soon as the
+// header is set by hand.
+func newGitHubRequest(url string) (*http.Request, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if githubToken != "" {
+		req.Header.Set("Authorization", "Bearer "+githubToken)
+	}
+	return req, nil
+}
+
+// logRateLimit logs the X-RateLimit-Remaining header of resp at debug level.
+// Responses without the header (e.g. raw.githubusercontent.com) are ignored.
+func logRateLimit(label string, resp *http.Response) {
+	remaining := resp.Header.Get("X-RateLimit-Remaining")
+	if remaining == "" {
+		return
+	}
+	slog.Debug("rate limit", "request", label, "remaining", remaining)
+}
+
+// ETagCache maps "owner/repo/branch" to the ETag of the last Cargo.toml
+// downloaded from that location. It is safe for concurrent use; a nil cache
+// stores nothing.
+type ETagCache struct {
+	mu      sync.Mutex
+	entries map[string]string
+}
+
+// Get returns the stored ETag for key, or "".
+func (c *ETagCache) Get(key string) string {
+	if c == nil {
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries[key]
+}
+
+// Set records etag for key.
+func (c *ETagCache) Set(key, etag string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = etag
+}
+
+// loadETagCache reads the ETag cache at path. A missing file yields an empty
+// cache.
+func loadETagCache(path string) (*ETagCache, error) {
+	etags := &ETagCache{entries: make(map[string]string)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return etags, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &etags.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return etags, nil
+}
+
+// saveETagCache writes the ETag cache to path as indented JSON.
+func saveETagCache(path string, etags *ETagCache) error {
+	etags.mu.Lock()
+	data, err := json.MarshalIndent(etags.entries, "", "  ")
+	etags.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFile(path, append(data, '\n'), 0644)
+}
+
+// readCachedCargoToml returns the content of a previously saved Cargo.toml
+// with the generated header comments removed.
+func readCachedCargoToml(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	content := string(data)
+	if strings.HasPrefix(content, "# Source:") {
+		if idx := strings.Index(content, "\n\n"); idx >= 0 {
+			content = content[idx+2:]
+		}
+	}
+	return content, nil
+}
+
+// etagKey is the ETag cache key of a manifest. The root Cargo.toml uses
+// "owner/repo/branch"; member manifests append their directory.
+func etagKey(owner, repo, branch, manifestPath string) string {
+	key := owner + "/" + repo + "/" + branch
+	if dir := path.Dir(manifestPath); dir != "." {
+		key += "/" + dir
+	}
+	return key
+}
+
+// fetchRawCargoToml requests the Cargo.toml of repo at branch, sending the
+// cached ETag as If-None-Match when a cached copy is available. Network
+// errors and 5xx responses are retried up to retries times with exponential
+// backoff; any other status, including 404, is returned as is.
+func fetchRawCargoToml(client *http.Client, owner, repo, branch, manifestPath string, etags *ETagCache, haveCache bool) (*http.Response, error) {
+	url := fmt.Sprintf("%s/%s/%s/%s/%s", rawBase, owner, repo, branch, manifestPath)
+
+	for attempt := 0; ; attempt++ {
+		req, err := newGitHubRequest(url)
+		if err != nil {
+			return nil, err
+		}
+		if etag := etags.Get(etagKey(owner, repo, branch, manifestPath)); haveCache && etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+
+		resp, err := client.Do(req)
+		if err == nil && resp.StatusCode < 500 {
+			return resp, nil
+		}
+		if attempt >= retries {
+			return resp, err
+		}
+
+		reason := fmt.Sprint(err)
+		if err == nil {
+			reason = fmt.Sprintf("HTTP %d", resp.StatusCode)
+			resp.Body.Close()
+		}
+		delay := retryDelay(attempt)
+		slog.Warn("retrying download", "repo", repo, "reason", reason,
+			"delay", delay.Round(time.Millisecond), "attempt", attempt+1, "retries", retries)
+		time.Sleep(delay)
+	}
+}
+
+// retryBaseDelay is the backoff before the first retry of a download.
+var retryBaseDelay = 500 * time.Millisecond
+
+// retryDelay returns the backoff before retry attempt+1: retryBaseDelay
+// doubled per attempt, plus up to 50% random jitter so parallel workers
+// don't retry in lockstep.
+func retryDelay(attempt int) time.Duration {
+	base := retryBaseDelay << attempt
+	return base + time.Duration(rand.Int63n(int64(base)/2+1))
+}
+
+// downloadCargoToml fetches the Cargo.toml at manifestPath (relative to the
+// repository root, normally "Cargo.toml") of repo. When cachedPath holds
+// a previous copy and GitHub answers 304 Not Modified, that copy is returned
+// and unchanged is true. etags is updated on every 200 response; a nil cache
+// disables conditional requests. Each of candidateBranches(branch) is tried
+// until one does not answer 404; usedBranch is the branch the file came
+// from.
+func downloadCargoToml(owner, repo, branch, manifestPath string, etags *ETagCache, cachedPath string) (content, usedBranch string, unchanged bool, err error) {
+	haveCache := false
+	if etags != nil {
+		if _, err := os.Stat(cachedPath); err == nil {
+			haveCache = true
+		}
+	}
+
+	var resp *http.Response
+	for _, candidate := range candidateBranches(branch) {
+		resp, err = fetchRawCargoToml(downloadClient, owner, repo, candidate, manifestPath, etags, haveCache)
+		if err != nil {
+			return "", "", false, fmt.Errorf("%s: %w", repo, err)
+		}
+		if resp.StatusCode != http.StatusNotFound {
+			branch = candidate
+			break
+		}
+		resp.Body.Close()
+		resp = nil
+	}
+	if resp == nil {
+		return "", "", false, fmt.Errorf("%w: %s in %s", errNotFound, manifestPath, repo)
+	}
+	defer resp.Body.Close()
+
+	logRateLimit(fmt.Sprintf("manifest fetch for %s", repo), resp)
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return "", "", false, errUnauthorized
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		content, err := readCachedCargoToml(cachedPath)
+		if err != nil {
+			return "", "", false, fmt.Errorf("reading cached Cargo.toml: %w", err)
+		}
+		return cargosnip.NormalizeLineEndings(cargosnip.StripBOM(content)), branch, true, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", false, fmt.Errorf("HTTP %d for %s", resp.StatusCode, repo)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", false, fmt.Errorf("%s: %w", repo, err)
+	}
+
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		etags.Set(etagKey(owner, repo, branch, manifestPath), etag)
+	}
+
+	return cargosnip.NormalizeLineEndings(cargosnip.StripBOM(string(body))), branch, false, nil
+}
+
+// enabledSections holds the section kinds chosen with -sections, or nil to
+// extract them all.
+var enabledSections map[string]bool
+
+// parseSectionKinds validates the -sections list and returns it as a set.
+func parseSectionKinds(names []string) (map[string]bool, error) {
+	known := make(map[string]bool, len(cargosnip.SectionKinds))
+	for _, kind := range cargosnip.SectionKinds {
+		known[kind] = true
+	}
+	enabled := make(map[string]bool, len(names))
+	for _, name := range names {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown section %q in -sections; known sections: %s", name, strings.Join(cargosnip.SectionKinds, ", "))
+		}
+		enabled[name] = true
+	}
+	return enabled, nil
+}
+
+// extractDependencySections returns the dependency sections of content that
+// -sections selects, keyed by section name.
+func extractDependencySections(content string) map[string]string {
+	sections := cargosnip.ExtractDependencySections(content)
+	if enabledSections == nil {
+		return sections
+	}
+	for name := range sections {
+		if !enabledSections[cargosnip.SectionKind(name)] {
+			delete(sections, name)
+		}
+	}
+	return sections
+}
+
+// skipLeadingJunk drops the non-TOML lines before the first table header of
+// content (see cargosnip.SkipLeadingJunk), warning when there were any.
+func skipLeadingJunk(repo, content string) string {
+	content, skipped := cargosnip.SkipLeadingJunk(content)
+	if skipped > 0 {
+		slog.Warn("skipped non-TOML lines before the first table header", "repo", repo, "lines", skipped)
+	}
+	return content
+}
+
+// unsafeNameChars matches runs of characters that are not filesystem-safe,
+// such as the dots, quotes and parentheses of target cfg section names.
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// safeSectionName makes a section name (or a member directory) usable in
+// file names and source IDs.
+func safeSectionName(sectionName string) string {
+	return strings.Trim(unsafeNameChars.ReplaceAllString(sectionName, "-"), "-")
+}
+
+// groupSourceID identifies a grouped snippet in the hash registry. repo is the
+// "owner/name" form so equal repo names under different owners stay distinct;
+// workspace members append ":dir" (see manifestResult.source).
+func groupSourceID(repo, sectionName string, groupIndex int) string {
+	return fmt.Sprintf("%s/%s/group%02d", repo, safeSectionName(sectionName), groupIndex)
+}
+
+// cargoAddSectionFlags returns the cargo add flags that select sectionName,
+// e.g. --dev for [dev-dependencies] or --target for target tables. ok is
+// false for sections cargo add cannot edit, such as
+// [workspace.dependencies] and [features].
+func cargoAddSectionFlags(sectionName string) (flags []string, ok bool) {
+	kind := sectionName
+	if rest, found := strings.CutPrefix(sectionName, "target."); found {
+		i := strings.LastIndex(rest, ".")
+		if i < 0 {
+			return nil, false
+		}
+		flags = append(flags, "--target", rest[:i])
+		kind = rest[i+1:]
+	}
+	switch kind {
+	case "dependencies":
+	case "dev-dependencies":
+		flags = append(flags, "--dev")
+	case "build-dependencies":
+		flags = append(flags, "--build")
+	default:
+		return nil, false
+	}
+	return flags, true
+}
+
+// cargoAddScript renders entries as one `cargo add` command each, under a
+// header like saveSnippet's. Entries that do not parse are listed as
+// comments.
+func cargoAddScript(source, sectionName string, entries []cargosnip.Entry, sectionFlags []string) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("# Source: %s\n# Section: [%s]\n# Auto-generated - do not edit\n", source, sectionName))
+	sb.WriteString("# Run from the package directory to add these dependencies.\n\n")
+	for _, entry := range entries {
+		if entry.Name == "" {
+			continue
+		}
+		dep, err := entry.Dependency()
+		if err != nil {
+			sb.WriteString(fmt.Sprintf("# skipped %s: %v\n", entry.Name, err))
+			continue
+		}
+		sb.WriteString(cargoAddCommand(dep, sectionFlags) + "\n")
+	}
+	return sb.String()
+}
+
+// cargoAddCommand returns the `cargo add` invocation that declares dep, with
+// sectionFlags appended. Inherited dependencies get no version, so cargo add
+// picks up the workspace entry.
+func cargoAddCommand(dep cargosnip.Dependency, sectionFlags []string) string {
+	crate := dep.Name
+	if dep.Package != "" {
+		crate = dep.Package
+	}
+	spec := crate
+	if dep.Version != "" && !dep.Workspace {
+		spec += "@" + dep.Version
+	}
+
+	args := []string{"cargo", "add", spec}
+	if dep.Package != "" {
+		args = append(args, "--rename", dep.Name)
+	}
+	if dep.Git != "" {
+		args = append(args, "--git", dep.Git)
+		switch {
+		case dep.Rev != "":
+			args = append(args, "--rev", dep.Rev)
+		case dep.Tag != "":
+			args = append(args, "--tag", dep.Tag)
+		case dep.Branch != "":
+			args = append(args, "--branch", dep.Branch)
+		}
+	}
+	if dep.Path != "" {
+		args = append(args, "--path", dep.Path)
+	}
+	if len(dep.Features) > 0 {
+		args = append(args, "--features", strings.Join(dep.Features, ","))
+	}
+	if !dep.DefaultFeatures {
+		args = append(args, "--no-default-features")
+	}
+	if dep.Optional {
+		args = append(args, "--optional")
+	}
+	args = append(args, sectionFlags...)
+
+	for i, arg := range args {
+		args[i] = shellQuote(arg)
+	}
+	return strings.Join(args, " ")
+}
+
+// shellUnsafe matches characters that need quoting in a POSIX shell word.
+var shellUnsafe = regexp.MustCompile(`[^A-Za-z0-9_@%+=:,./-]`)
+
+// shellQuote quotes arg for a POSIX shell when it contains anything beyond
+// plain word characters.
+func shellQuote(arg string) string {
+	if arg != "" && !shellUnsafe.MatchString(arg) {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// saveSnippet writes a full section to {stem}_{section}.toml with a header
+// naming source, the "owner/name" of the repository (plus ":dir" for a
+// workspace member). notes, if any, are comment lines placed after the
+// header. It returns the snippet's file name.
+func saveSnippet(outputDir, stem, source, sectionName, content, notes string) (string, string, error) {
+	safeSection := safeSectionName(sectionName)
+	filename := fmt.Sprintf("%s_%s.toml", stem, safeSection)
+	filepath := filepath.Join(outputDir, filename)
+
+	fullContent := fmt.Sprintf("# Source: %s\n# Section: [%s]\n# Auto-generated - do not edit\n\n%s%s\n",
+		source, sectionName, notes, content)
+
+	if err := writeFile(filepath, []byte(fullContent), 0644); err != nil {
+		return "", "", fmt.Errorf("saving snippet: %w", err)
+	}
+
+	return filename, fullContent, nil
+}
+
+// HashedSnippetMeta is the content of the {hash}.json sidecar kept next to
+// each hashed snippet, so that the .toml holds only dependency content.
+type HashedSnippetMeta struct {
+	Hash           string   `json:"hash"`
+	Sources        []string `json:"sources"`
+	PathDependency bool     `json:"path_dependency,omitempty"`
+}
+
+// sidecarPath returns the metadata sidecar of the hashed snippet at tomlPath.
+func sidecarPath(tomlPath string) string {
+	return strings.TrimSuffix(tomlPath, snippetExt()) + ".json"
+}
+
+// readHashedMeta loads the metadata of the hashed snippet at tomlPath. Files
+// from before the sidecar existed carry "# Hash:" and "# Sources:" header
+// comments instead; those are parsed and reported with legacy set. found is
+// false when there is no snippet at tomlPath.
+func readHashedMeta(tomlPath string) (meta HashedSnippetMeta, found, legacy bool, err error) {
+	data, err := os.ReadFile(sidecarPath(tomlPath))
+	if err == nil {
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return meta, false, false, fmt.Errorf("parsing %s: %w", sidecarPath(tomlPath), err)
+		}
+		return meta, true, false, nil
+	}
+	if !os.IsNotExist(err) {
+		return meta, false, false, err
+	}
+
+	data, err = os.ReadFile(tomlPath)
+	if os.IsNotExist(err) {
+		return meta, false, false, nil
+	} else if err != nil {
+		return meta, false, false, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		switch {
+		case strings.HasPrefix(line, "# Hash:"):
+			meta.Hash = strings.TrimSpace(strings.TrimPrefix(line, "# Hash:"))
+		case strings.HasPrefix(line, "# Sources:"):
+			for _, source := range strings.Split(strings.TrimPrefix(line, "# Sources:"), ",") {
+				if source = strings.TrimSpace(source); source != "" {
+					meta.Sources = append(meta.Sources, source)
+				}
+			}
+		case strings.HasPrefix(line, "# WARNING: contains path dependency"):
+			meta.PathDependency = true
+		}
+	}
+	return meta, true, true, nil
+}
+
+// writeHashedMeta writes the sidecar of the hashed snippet at tomlPath.
+func writeHashedMeta(tomlPath string, meta HashedSnippetMeta) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(sidecarPath(tomlPath), append(data, '\n'), 0644)
+}
+
+// stripLegacyHeader drops the comment header that hashed snippets carried
+// before their metadata moved to the sidecar.
+func stripLegacyHeader(data string) string {
+	if !strings.HasPrefix(data, "# Hash:") {
+		return data
+	}
+	if i := strings.Index(data, "\n\n"); i >= 0 {
+		return data[i+2:]
+	}
+	return data
+}
+
+// storedFullHash returns the full hash recorded for the hashed snippet at
+// path, or "" if there is none.
+func storedFullHash(path string) (string, error) {
+	meta, _, _, err := readHashedMeta(path)
+	return meta.Hash, err
+}
+
+// hashedSnippetPath picks the file for contentHash in hashDir. It starts
+// with the 16-character short hash and, if that file already holds a
+// different full hash, extends the name 8 characters at a time until it
+// finds a free or matching file.
+func hashedSnippetPath(hashDir, contentHash string) (string, string) {
+	for length := 16; ; length += 8 {
+		if length > len(contentHash) {
+			length = len(contentHash)
+		}
+		shortHash := contentHash[:length]
+		path := filepath.Join(hashDir, shortHash+snippetExt())
+
+		stored, err := storedFullHash(path)
+		if err != nil || stored == "" || stored == contentHash || length == len(contentHash) {
+			return path, shortHash
+		}
+		slog.Warn("short hash collision; extending file name",
+			"file", shortHash+snippetExt(), "stored", stored, "hash", contentHash)
+	}
+}
+
+func saveHashedSnippet(hashDir, content string, sources []string) (string, string, error) {
+	contentHash := cargosnip.ComputeContentHash(content)
+	filepath, shortHash := hashedSnippetPath(hashDir, contentHash)
+
+	meta, found, legacy, err := readHashedMeta(filepath)
+	if err != nil {
+		return filepath, shortHash, fmt.Errorf("reading hashed snippet metadata: %w", err)
+	}
+
+	// New snippets and ones still carrying the old comment header get a
+	// file with nothing but the dependency content, as do known snippets
+	// missing their body in this -format
+	_, statErr := os.Stat(filepath)
+	if !found || legacy || os.IsNotExist(statErr) {
+		if err := writeFile(filepath, []byte(renderSnippet(content)), 0644); err != nil {
+			return filepath, shortHash, fmt.Errorf("saving hashed snippet: %w", err)
+		}
+	}
+
+	// Merge the stored and new sources without repeats, for new snippets
+	// as well as known ones
+	sourceMap := make(map[string]bool)
+	for _, s := range meta.Sources {
+		sourceMap[s] = true
+	}
+	for _, s := range sources {
+		sourceMap[s] = true
+	}
+	var allSources []string
+	for s := range sourceMap {
+		allSources = append(allSources, s)
+	}
+	sort.Strings(allSources)
+
+	meta.Hash = contentHash
+	meta.Sources = allSources
+	meta.PathDependency = hasPathDependency(content)
+	if err := writeHashedMeta(filepath, meta); err != nil {
+		return filepath, shortHash, fmt.Errorf("saving hashed snippet metadata: %w", err)
+	}
+
+	return filepath, shortHash, nil
+}
+
+// SnippetDependency is one dependency of a hashed snippet written with
+// -format json or yaml. Fields mirror the Cargo.toml keys and are omitted
+// when unset.
+type SnippetDependency struct {
+	Name            string   `json:"name"`
+	Version         string   `json:"version,omitempty"`
+	Features        []string `json:"features,omitempty"`
+	Optional        bool     `json:"optional,omitempty"`
+	Git             string   `json:"git,omitempty"`
+	Branch          string   `json:"branch,omitempty"`
+	Tag             string   `json:"tag,omitempty"`
+	Rev             string   `json:"rev,omitempty"`
+	Path            string   `json:"path,omitempty"`
+	Package         string   `json:"package,omitempty"`
+	DefaultFeatures *bool    `json:"default-features,omitempty"` // only set when false
+	Workspace       bool     `json:"workspace,omitempty"`
+	Comments        []string `json:"comments,omitempty"`
+	Raw             string   `json:"raw,omitempty"` // the TOML of an entry that does not parse
+}
+
+// snippetDependencies converts a dependency group to its SnippetDependency
+// list, in declaration order.
+func snippetDependencies(content string) []SnippetDependency {
+	deps := make([]SnippetDependency, 0)
+	for _, entry := range cargosnip.SplitEntries(content) {
+		if entry.Name == "" {
+			continue
+		}
+		dep, err := entry.Dependency()
+		if err != nil {
+			deps = append(deps, SnippetDependency{Name: entry.Name, Raw: strings.Join(trimCommentLines(entry.Raw), "\n")})
+			continue
+		}
+		sd := SnippetDependency{
+			Name: dep.Name, Version: dep.Version, Features: dep.Features, Optional: dep.Optional,
+			Git: dep.Git, Branch: dep.Branch, Tag: dep.Tag, Rev: dep.Rev, Path: dep.Path, Package: dep.Package,
+			Workspace: dep.Workspace, Comments: dep.Comments,
+		}
+		if !dep.DefaultFeatures {
+			sd.DefaultFeatures = &dep.DefaultFeatures
+		}
+		deps = append(deps, sd)
+	}
+	return deps
+}
+
+// renderSnippet returns the body of a hashed snippet for content, a
+// dependency group, in -format. The hash is always taken over the TOML, so
+// the format does not affect dedup.
+func renderSnippet(content string) string {
+	switch snippetFormat {
+	case "json":
+		data, _ := json.MarshalIndent(snippetDependencies(content), "", "  ")
+		return string(data) + "\n"
+	case "yaml":
+		return yamlSnippet(snippetDependencies(content))
+	}
+	return content + "\n"
+}
+
+// yamlSnippet renders deps as a YAML sequence with the same fields, in the
+// same order, as the JSON form. Values are written as JSON, which YAML reads
+// as flow scalars and sequences.
+func yamlSnippet(deps []SnippetDependency) string {
+	if len(deps) == 0 {
+		return "[]\n"
+	}
+	var sb strings.Builder
+	yamlValue := func(v any) string {
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+	field := func(key string, value any) {
+		sb.WriteString("  " + key + ": " + yamlValue(value) + "\n")
+	}
+	stringField := func(key, value string) {
+		if value != "" {
+			field(key, value)
+		}
+	}
+	for _, dep := range deps {
+		sb.WriteString("- name: " + yamlValue(dep.Name) + "\n")
+		stringField("version", dep.Version)
+		if len(dep.Features) > 0 {
+			field("features", dep.Features)
+		}
+		if dep.Optional {
+			field("optional", true)
+		}
+		stringField("git", dep.Git)
+		stringField("branch", dep.Branch)
+		stringField("tag", dep.Tag)
+		stringField("rev", dep.Rev)
+		stringField("path", dep.Path)
+		stringField("package", dep.Package)
+		if dep.DefaultFeatures != nil {
+			field("default-features", *dep.DefaultFeatures)
+		}
+		if dep.Workspace {
+			field("workspace", true)
+		}
+		if len(dep.Comments) > 0 {
+			field("comments", dep.Comments)
+		}
+		stringField("raw", dep.Raw)
+	}
+	return sb.String()
+}
+
+// writeFile is os.WriteFile, except that in -dry-run mode it only reports
+// the write at debug level and touches nothing.
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	if dryRun {
+		slog.Debug("dry run: would write", "path", path, "bytes", len(data))
+		return nil
+	}
+	return os.WriteFile(path, data, perm)
+}
+
+// createSymlink points symlinkPath at targetPath with a relative symlink.
+// With -copy-instead-of-symlink, or when the platform refuses the symlink
+// (e.g. Windows without developer mode), a copy of the target is written
+// instead.
+func createSymlink(symlinkPath, targetPath string) error {
+	if dryRun {
+		slog.Debug("dry run: would link", "path", symlinkPath, "target", targetPath)
+		return nil
+	}
+
+	// Remove existing file/symlink if it exists
+	os.Remove(symlinkPath)
+
+	if copyInsteadOfSymlink {
+		return copyFile(symlinkPath, targetPath)
+	}
+
+	// Create relative symlink
+	symlinkDir := filepath.Dir(symlinkPath)
+	relTarget, err := filepath.Rel(symlinkDir, targetPath)
+	if err != nil {
+		return fmt.Errorf("creating relative path: %w", err)
+	}
+
+	if err := os.Symlink(relTarget, symlinkPath); err != nil {
+		symlinkFallbackOnce.Do(func() {
+			slog.Warn("symlinks unavailable; copying grouped snippets instead", "err", err)
+		})
+		return copyFile(symlinkPath, targetPath)
+	}
+	return nil
+}
+
+// symlinkFallbackOnce limits the symlink fallback warning to one per run.
+var symlinkFallbackOnce sync.Once
+
+// copyFile writes the contents of targetPath to path.
+func copyFile(path, targetPath string) error {
+	data, err := os.ReadFile(targetPath)
+	if err != nil {
+		return fmt.Errorf("copying %s: %w", filepath.Base(targetPath), err)
+	}
+	if err := writeFile(path, data, 0644); err != nil {
+		return fmt.Errorf("copying %s: %w", filepath.Base(targetPath), err)
+	}
+	return nil
+}
+
+func saveGroupedSnippet(groupedDir, hashDir, stem, repo, sectionName string, groupIndex int,
+	content string, hashRegistry HashRegistry, snippetIndex SnippetIndex) (string, string, error) {
+
+	// Source identifier for this snippet
+	safeSection := safeSectionName(sectionName)
+	sourceID := groupSourceID(repo, sectionName, groupIndex)
+
+	// Save to hash-based file; the short hash may be extended on collision
+	hashFile, shortHash, err := saveHashedSnippet(hashDir, content, []string{sourceID})
+
+	// Track sources for this hash, even if the write failed, so the stats
+	// still describe every group
+	hashRegistry[shortHash] = appendUnique(hashRegistry[shortHash], sourceID)
+	snippetIndex.record(shortHash, cargosnip.ComputeContentHash(content), hashFile, sectionName)
+	if err != nil {
+		return "", shortHash, err
+	}
+
+	// Create symlink with the friendly name
+	symlinkName := fmt.Sprintf("%s_%s_group%02d%s", stem, safeSection, groupIndex, snippetExt())
+	symlinkPath := filepath.Join(groupedDir, symlinkName)
+	if err := createSymlink(symlinkPath, hashFile); err != nil {
+		return symlinkPath, shortHash, err
+	}
+
+	return symlinkPath, shortHash, nil
+}
+
+// record notes that the snippet stored at path under shortHash was seen in
+// sectionName.
+func (idx SnippetIndex) record(shortHash, contentHash, path, sectionName string) {
+	entry := idx[shortHash]
+	if entry == nil {
+		entry = &ManifestEntry{Hash: contentHash, ShortHash: shortHash, Path: path}
+		idx[shortHash] = entry
+	}
+	for _, s := range entry.Sections {
+		if s == sectionName {
+			return
+		}
+	}
+	entry.Sections = append(entry.Sections, sectionName)
+	sort.Strings(entry.Sections)
+}
+
+// saveManifest writes manifest.json with one entry per unique hash, sorted
+// by short hash. Paths are relative to the manifest's directory.
+func saveManifest(path string, hashRegistry HashRegistry, snippetIndex SnippetIndex, sources map[string]*ManifestSource) error {
+	manifest := Manifest{Snippets: make([]ManifestEntry, 0, len(snippetIndex))}
+	for _, source := range sources {
+		ms := *source
+		ms.Files = make([]string, 0, len(source.Files))
+		for _, file := range source.Files {
+			ms.Files = append(ms.Files, manifestRelPath(path, file))
+		}
+		sort.Strings(ms.Files)
+		sort.Strings(ms.Sections)
+		sort.Slice(ms.Groups, func(i, j int) bool {
+			if ms.Groups[i].Section != ms.Groups[j].Section {
+				return ms.Groups[i].Section < ms.Groups[j].Section
+			}
+			return ms.Groups[i].Index < ms.Groups[j].Index
+		})
+		sort.SliceStable(ms.Dependencies, func(i, j int) bool {
+			return ms.Dependencies[i].Section < ms.Dependencies[j].Section
+		})
+		sort.SliceStable(ms.DependencySnippets, func(i, j int) bool {
+			return ms.DependencySnippets[i].Section < ms.DependencySnippets[j].Section
+		})
+		manifest.Sources = append(manifest.Sources, ms)
+	}
+	sort.Slice(manifest.Sources, func(i, j int) bool {
+		return manifest.Sources[i].Source < manifest.Sources[j].Source
+	})
+	for shortHash, entry := range snippetIndex {
+		e := *entry
+		e.Path = manifestRelPath(path, entry.Path)
+		e.Sources = append([]string(nil), hashRegistry[shortHash]...)
+		sort.Strings(e.Sources)
+		manifest.Snippets = append(manifest.Snippets, e)
+	}
+	sort.Slice(manifest.Snippets, func(i, j int) bool {
+		return manifest.Snippets[i].ShortHash < manifest.Snippets[j].ShortHash
+	})
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, append(data, '\n'), 0644)
+}
+
+// saveDependencyIndex writes the per-crate index of -dep-level-dedup
+// snippets to path. Each crate lists its distinct declarations, the most
+// widely shared first.
+func saveDependencyIndex(path string, depSnippets map[string]map[string]*DependencySnippet) error {
+	index := make(map[string][]DependencySnippet, len(depSnippets))
+	for crate, byFile := range depSnippets {
+		snippets := make([]DependencySnippet, 0, len(byFile))
+		for _, snippet := range byFile {
+			s := *snippet
+			sort.Strings(s.Sources)
+			sort.Strings(s.Sections)
+			sort.Strings(s.Comments)
+			snippets = append(snippets, s)
+		}
+		sort.Slice(snippets, func(i, j int) bool {
+			if len(snippets[i].Sources) != len(snippets[j].Sources) {
+				return len(snippets[i].Sources) > len(snippets[j].Sources)
+			}
+			return snippets[i].ShortHash < snippets[j].ShortHash
+		})
+		index[crate] = snippets
+	}
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, append(data, '\n'), 0644)
+}
+
+// saveRunSummary writes stats, the hash registry and the duplicate count to
+// path as JSON, with sources sorted so runs can be diffed.
+func saveRunSummary(path string, stats Stats, hashRegistry HashRegistry, duplicates int) error {
+	registry := make(HashRegistry, len(hashRegistry))
+	for shortHash, sources := range hashRegistry {
+		sorted := append([]string(nil), sources...)
+		sort.Strings(sorted)
+		registry[shortHash] = sorted
+	}
+	sort.Strings(stats.ReposWithDeps)
+
+	data, err := json.MarshalIndent(RunSummary{Stats: stats, Duplicates: duplicates, HashRegistry: registry}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, append(data, '\n'), 0644)
+}
+
+// manifestRelPath returns file relative to the directory of manifest.json at
+// manifestPath, in slash form.
+func manifestRelPath(manifestPath, file string) string {
+	rel, err := filepath.Rel(filepath.Dir(manifestPath), file)
+	if err != nil {
+		return file
+	}
+	return filepath.ToSlash(rel)
+}
+
+// loadManifest reads the manifest.json written by a previous run, with
+// paths resolved back to absolute ones. A missing file yields an empty
+// manifest.
+func loadManifest(path string) (Manifest, error) {
+	var manifest Manifest
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return manifest, err
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	dir := filepath.Dir(path)
+	for i := range manifest.Snippets {
+		manifest.Snippets[i].Path = filepath.Join(dir, filepath.FromSlash(manifest.Snippets[i].Path))
+	}
+	for i := range manifest.Sources {
+		for j, file := range manifest.Sources[i].Files {
+			manifest.Sources[i].Files[j] = filepath.Join(dir, filepath.FromSlash(file))
+		}
+	}
+	return manifest, nil
+}
+
+// pruneSourceFiles removes the section snippets and grouped links of a
+// source that no longer exists. Hashed snippets are left alone since other
+// sources may share them.
+func pruneSourceFiles(source ManifestSource) {
+	for _, file := range source.Files {
+		if dryRun {
+			slog.Debug("dry run: would remove", "path", file)
+			continue
+		}
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			slog.Warn("failed to prune stale file", "path", file, "err", err)
+		}
+	}
+	slog.Info("pruned stale source", "source", source.Source, "files", len(source.Files))
+}
+
+// sourceRepo returns the "owner/name" of a source or source ID such as
+// "owner/name:crates/foo/dependencies/group01", or of a "# Source:" header
+// value such as "owner/name@main".
+func sourceRepo(source string) string {
+	owner, rest, _ := strings.Cut(source, "/")
+	name, _, _ := strings.Cut(rest, "/")
+	name, _, _ = strings.Cut(name, ":")
+	name, _, _ = strings.Cut(name, "@")
+	return owner + "/" + name
+}
+
+// snippetSourceHeader returns the value of the "# Source:" header of the
+// generated file at path, or "" when it has none.
+func snippetSourceHeader(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	first, _, _ := strings.Cut(string(data), "\n")
+	if !strings.HasPrefix(first, "# Source:") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(first, "# Source:"))
+}
+
+// removeStale deletes a stale output file, or only logs it in -dry-run mode.
+func removeStale(path string) {
+	if dryRun {
+		slog.Debug("dry run: would remove", "path", path)
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		slog.Warn("failed to prune stale file", "path", path, "err", err)
+	}
+}
+
+// pruneStaleOutputs removes the outputs of repositories that are not in
+// listed, the "owner/name" set of this run:
+//   - section snippets and Cargo.toml copies whose "# Source:" header names
+//     an unlisted repository;
+//   - sidecar sources of hashed snippets from unlisted repositories,
+//     deleting hashed snippets (and sidecars) left with no sources;
+//   - grouped links that do not start with one of stems or whose hashed
+//     snippet is gone.
+func pruneStaleOutputs(outputDir, groupedDir, hashDir, cargoTomlsDir string, listed map[string]bool, stems []string) {
+	removed := 0
+
+	// Section snippets, cargo-tomls copies and -cargo-add scripts all start
+	// with a "# Source:" header
+	for _, pattern := range []string{
+		filepath.Join(outputDir, "*.toml"), filepath.Join(cargoTomlsDir, "*.toml"),
+		filepath.Join(outputDir, "*.sh"), filepath.Join(groupedDir, "*.sh"),
+	} {
+		files, _ := filepath.Glob(pattern)
+		for _, file := range files {
+			if source := snippetSourceHeader(file); source != "" && !listed[sourceRepo(source)] {
+				removeStale(file)
+				removed++
+			}
+		}
+	}
+
+	hashedFiles, _ := filepath.Glob(filepath.Join(hashDir, "*"+snippetExt()))
+	deletedHashes := make(map[string]bool)
+	for _, file := range hashedFiles {
+		meta, found, legacy, err := readHashedMeta(file)
+		if err != nil || !found {
+			continue
+		}
+		var kept []string
+		for _, source := range meta.Sources {
+			if listed[sourceRepo(source)] {
+				kept = append(kept, source)
+			}
+		}
+		if len(kept) == 0 {
+			removeStale(file)
+			removeStale(sidecarPath(file))
+			deletedHashes[file] = true
+			removed++
+			continue
+		}
+		if len(kept) == len(meta.Sources) && !legacy {
+			continue
+		}
+		if legacy {
+			if data, err := os.ReadFile(file); err == nil {
+				if err := writeFile(file, []byte(stripLegacyHeader(string(data))), 0644); err != nil {
+					slog.Warn("failed to rewrite hashed snippet", "path", file, "err", err)
+				}
+			}
+		}
+		meta.Sources = kept
+		if err := writeHashedMeta(file, meta); err != nil {
+			slog.Warn("failed to rewrite hashed snippet sources", "path", file, "err", err)
+		}
+	}
+
+	links, _ := filepath.Glob(filepath.Join(groupedDir, "*"+snippetExt()))
+	for _, link := range links {
+		known := false
+		for _, stem := range stems {
+			if strings.HasPrefix(filepath.Base(link), stem+"_") {
+				known = true
+				break
+			}
+		}
+		target, err := filepath.EvalSymlinks(link)
+		dangling := err != nil || deletedHashes[target]
+		if !known || dangling {
+			removeStale(link)
+			removed++
+		}
+	}
+
+	slog.Info("pruned stale outputs", "files", removed)
+}
+
+// compactHashedSnippets deletes the hashed snippets in hashDir, and their
+// sidecars, that no grouped snippet in groupedDir refers to. Grouped
+// symlinks refer to their target; grouped copies (-copy-instead-of-symlink)
+// to the hashed snippet with the same bytes. It returns the number of files
+// removed and their total size.
+func compactHashedSnippets(groupedDir, hashDir string) (files int, bytes int64, err error) {
+	hashedFiles, err := filepath.Glob(filepath.Join(hashDir, "*"+snippetExt()))
+	if err != nil {
+		return 0, 0, err
+	}
+	byContent := make(map[string]string)
+	for _, file := range hashedFiles {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return 0, 0, fmt.Errorf("reading hashed snippet: %w", err)
+		}
+		byContent[string(data)] = file
+	}
+
+	referenced := make(map[string]bool)
+	links, _ := filepath.Glob(filepath.Join(groupedDir, "*"+snippetExt()))
+	for _, link := range links {
+		info, err := os.Lstat(link)
+		if err != nil {
+			continue
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if target, err := filepath.EvalSymlinks(link); err == nil {
+				referenced[target] = true
+			}
+			continue
+		}
+		if data, err := os.ReadFile(link); err == nil {
+			referenced[byContent[string(data)]] = true
+		}
+	}
+
+	// EvalSymlinks resolves hashDir too, so compare resolved paths
+	for _, file := range hashedFiles {
+		resolved, err := filepath.EvalSymlinks(file)
+		if err != nil || referenced[resolved] || referenced[file] {
+			continue
+		}
+		for _, path := range []string{file, sidecarPath(file)} {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			removeStale(path)
+			files++
+			bytes += info.Size()
+		}
+	}
+
+	slog.Info("compacted hashed snippets", "files", files, "bytes", bytes)
+	return files, bytes, nil
+}
+
+// collectDependencyUses lists the dependencies declared in the groups of one
+// section of repo. Entries inheriting from the workspace take their source
+// from workspace when it declares them.
+func collectDependencyUses(repo, sectionName string, groups []string, workspace map[string]cargosnip.Dependency) []DependencyUse {
+	var uses []DependencyUse
+	for _, group := range groups {
+		for _, entry := range cargosnip.SplitEntries(group) {
+			if entry.Name == "" {
+				continue
+			}
+			// Unparseable entries are still counted, just without details
+			dep, _ := entry.Dependency()
+			if inherited, ok := workspace[entry.Name]; ok && dep.Workspace {
+				dep.Version, dep.Git, dep.Branch, dep.Tag, dep.Rev, dep.Path = inherited.Version, inherited.Git, inherited.Branch, inherited.Tag, inherited.Rev, inherited.Path
+				if dep.Package == "" {
+					dep.Package = inherited.Package
+				}
+			}
+			uses = append(uses, DependencyUse{
+				Repo:     repo,
+				Section:  sectionName,
+				Name:     entry.Name,
+				Version:  dep.Version,
+				Git:      dep.Git,
+				GitRef:   dep.GitRef(),
+				Path:     dep.Path,
+				Package:  dep.Package,
+				Comments: dep.Comments,
+			})
+		}
+	}
+	return uses
+}
+
+// isPathDependency reports whether entry points at a local path.
+func isPathDependency(e cargosnip.Entry) bool {
+	dep, err := e.Dependency()
+	return err == nil && dep.Path != ""
+}
+
+// hasPathDependency reports whether a dependency group contains a path
+// dependency.
+func hasPathDependency(group string) bool {
+	for _, entry := range cargosnip.SplitEntries(group) {
+		if isPathDependency(entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// portableGroups applies -skip-path-deps and -min-group-size to the groups
+// of a section: path dependency entries are removed, keeping the original
+// text of the rest, and groups left with fewer than minGroupSize
+// dependencies (or none at all) are dropped. The removed entries and the
+// groups below the minimum are counted in stats.
+func portableGroups(groups []string, stats *Stats) []string {
+	if !skipPathDeps && minGroupSize <= 1 {
+		return groups
+	}
+	var kept []string
+	for _, group := range groups {
+		var lines []string
+		deps := 0
+		for _, entry := range cargosnip.SplitEntries(group) {
+			if skipPathDeps && isPathDependency(entry) {
+				stats.PathDepsSkipped++
+				continue
+			}
+			lines = append(lines, entry.Raw...)
+			if entry.Name != "" {
+				deps++
+			}
+		}
+		switch {
+		case deps == 0:
+		case deps < minGroupSize:
+			stats.SmallGroupsSkipped++
+		default:
+			kept = append(kept, strings.Join(lines, "\n"))
+		}
+	}
+	return kept
+}
+
+// isOptional reports whether entry declares an optional dependency.
+func isOptional(e cargosnip.Entry) bool {
+	dep, err := e.Dependency()
+	return err == nil && dep.Optional
+}
+
+// sectionEntries returns the entries of every group of a section.
+func sectionEntries(content string) []cargosnip.Entry {
+	var entries []cargosnip.Entry
+	for _, group := range cargosnip.SplitByBlankLines(content) {
+		entries = append(entries, cargosnip.SplitEntries(group)...)
+	}
+	return entries
+}
+
+// featureValuePattern matches the quoted strings of a feature's array.
+var featureValuePattern = regexp.MustCompile(`"([^"]*)"`)
+
+// featureReferences maps each dependency named in the [features] section
+// content to the features that enable it, whether as "dep:foo", "foo",
+// "foo/feature" or "foo?/feature".
+func featureReferences(features string) map[string][]string {
+	refs := make(map[string][]string)
+	for _, entry := range sectionEntries(features) {
+		if entry.Name == "" {
+			continue
+		}
+		seen := make(map[string]bool)
+		keyStripped := false
+		for _, line := range entry.Lines {
+			if strings.HasPrefix(line, "#") {
+				continue
+			}
+			// Drop the feature name so a quoted key isn't read as a value
+			if !keyStripped {
+				_, line, _ = strings.Cut(line, "=")
+				keyStripped = true
+			}
+			for _, m := range featureValuePattern.FindAllStringSubmatch(line, -1) {
+				dep := strings.TrimPrefix(m[1], "dep:")
+				if i := strings.IndexAny(dep, "?/"); i >= 0 {
+					dep = dep[:i]
+				}
+				if dep != "" && !seen[dep] {
+					seen[dep] = true
+					refs[dep] = append(refs[dep], entry.Name)
+				}
+			}
+		}
+	}
+	return refs
+}
+
+// optionalDependencyNotes returns comment lines listing the optional
+// dependencies of a section and the features that reference them, or "" when
+// the section has none.
+func optionalDependencyNotes(content string, features map[string][]string) string {
+	var b strings.Builder
+	for _, entry := range sectionEntries(content) {
+		if entry.Name == "" || !isOptional(entry) {
+			continue
+		}
+		if refs := features[entry.Name]; len(refs) > 0 {
+			fmt.Fprintf(&b, "# Optional: %s (enabled by features: %s)\n", entry.Name, strings.Join(refs, ", "))
+		} else {
+			fmt.Fprintf(&b, "# Optional: %s (not referenced by any feature)\n", entry.Name)
+		}
+	}
+	if b.Len() == 0 {
+		return ""
+	}
+	return b.String() + "\n"
+}
+
+// workspaceDependencies parses the [workspace.dependencies] section of a root
+// manifest's sections, by dependency name. Unparseable entries are left out.
+func workspaceDependencies(sections map[string]string) map[string]cargosnip.Dependency {
+	deps := make(map[string]cargosnip.Dependency)
+	for _, entry := range sectionEntries(sections["workspace.dependencies"]) {
+		if entry.Name == "" {
+			continue
+		}
+		if dep, err := entry.Dependency(); err == nil {
+			deps[entry.Name] = dep
+		}
+	}
+	return deps
+}
+
+// inheritsWorkspace reports whether entry is declared as
+// `foo.workspace = true` or `foo = { workspace = true, ... }`.
+func inheritsWorkspace(e cargosnip.Entry) bool {
+	dep, err := e.Dependency()
+	return err == nil && dep.Workspace
+}
+
+// inheritedSource describes what an entry inheriting name resolves to in
+// workspace, e.g. `version = "1.0"`, or "" when the workspace does not
+// declare it.
+func inheritedSource(name string, workspace map[string]cargosnip.Dependency) string {
+	dep, ok := workspace[name]
+	switch {
+	case !ok:
+		return ""
+	case dep.Git != "":
+		source := fmt.Sprintf("git = %q", dep.Git)
+		if kind, ref, ok := strings.Cut(dep.GitRef(), " "); ok {
+			source += fmt.Sprintf(", %s = %q", kind, ref)
+		}
+		return source
+	case dep.Path != "":
+		return fmt.Sprintf("path = %q", dep.Path)
+	case dep.Version != "":
+		return fmt.Sprintf("version = %q", dep.Version)
+	}
+	return ""
+}
+
+// workspaceInheritanceNotes returns comment lines listing the dependencies of
+// a section that inherit from the workspace and what they resolve to, or ""
+// when the section has none.
+func workspaceInheritanceNotes(content string, workspace map[string]cargosnip.Dependency) string {
+	var b strings.Builder
+	for _, entry := range sectionEntries(content) {
+		if entry.Name == "" || !inheritsWorkspace(entry) {
+			continue
+		}
+		if resolved := inheritedSource(entry.Name, workspace); resolved != "" {
+			fmt.Fprintf(&b, "# Inherited: %s from workspace (%s)\n", entry.Name, resolved)
+		} else {
+			fmt.Fprintf(&b, "# Inherited: %s from workspace (not found in the root [workspace.dependencies])\n", entry.Name)
+		}
+	}
+	if b.Len() == 0 {
+		return ""
+	}
+	return b.String() + "\n"
+}
+
+// annotateInheritedGroups puts a "# inherits from workspace" comment, with
+// the resolved source when workspace has it, above every inherited entry of
+// groups, so a version-less line is never copied on its own.
+func annotateInheritedGroups(groups []string, workspace map[string]cargosnip.Dependency) []string {
+	annotated := make([]string, len(groups))
+	for i, group := range groups {
+		var lines []string
+		for _, entry := range cargosnip.SplitEntries(group) {
+			if entry.Name == "" || !inheritsWorkspace(entry) {
+				lines = append(lines, entry.Raw...)
+				continue
+			}
+			comment := "# inherits from workspace"
+			if resolved := inheritedSource(entry.Name, workspace); resolved != "" {
+				comment += ": " + resolved
+			}
+			// Keep the entry's own leading comments above the marker
+			declaration := 0
+			for declaration < len(entry.Raw) && isCommentOrBlank(entry.Raw[declaration]) {
+				declaration++
+			}
+			lines = append(lines, entry.Raw[:declaration]...)
+			lines = append(lines, comment)
+			lines = append(lines, entry.Raw[declaration:]...)
+		}
+		annotated[i] = strings.Join(lines, "\n")
+	}
+	return annotated
+}
+
+// crateStats aggregates how often one crate is used.
+type crateStats struct {
+	name     string
+	repos    map[string]bool
+	versions map[string]int
+}
+
+// popularVersion returns the most used version requirement, preferring the
+// lexically smallest on ties, or "" when no use declares a version.
+func (c *crateStats) popularVersion() string {
+	best, bestCount := "", 0
+	for v, n := range c.versions {
+		if n > bestCount || n == bestCount && v < best {
+			best, bestCount = v, n
+		}
+	}
+	return best
+}
+
+// rankCrates aggregates the versioned crates of the [dependencies] sections
+// in uses, most used first and then by name. Renamed dependencies count
+// towards the crate they rename.
+func rankCrates(uses []DependencyUse) []*crateStats {
+	byName := make(map[string]*crateStats)
+	for _, use := range uses {
+		if use.Section != "dependencies" {
+			continue
+		}
+		name := use.crate()
+		c := byName[name]
+		if c == nil {
+			c = &crateStats{name: name, repos: make(map[string]bool), versions: make(map[string]int)}
+			byName[name] = c
+		}
+		c.repos[use.Repo] = true
+		if use.Version != "" {
+			c.versions[use.Version]++
+		}
+	}
+
+	var ranked []*crateStats
+	for _, c := range byName {
+		if len(c.versions) > 0 {
+			ranked = append(ranked, c)
+		}
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if len(ranked[i].repos) != len(ranked[j].repos) {
+			return len(ranked[i].repos) > len(ranked[j].repos)
+		}
+		return ranked[i].name < ranked[j].name
+	})
+	return ranked
+}
+
+// saveMostCommon writes a Cargo.toml-style [dependencies] table of the top
+// crates from the [dependencies] sections of all repos, each with its most
+// popular version requirement and the number of repos using it.
+func saveMostCommon(path string, owners []string, uses []DependencyUse, top int) error {
+	ranked := rankCrates(uses)
+	if top > 0 && len(ranked) > top {
+		ranked = ranked[:top]
+	}
+	title := fmt.Sprintf("Most common dependencies across the %s organization repositories", strings.Join(owners, ", "))
+	return writeFile(path, []byte(rankedDependencies(title, ranked)), 0644)
+}
+
+// rankedDependencies renders ranked as a [dependencies] table under a
+// title comment.
+func rankedDependencies(title string, ranked []*crateStats) string {
+	var sb strings.Builder
+	sb.WriteString("# " + title + "\n")
+	sb.WriteString("# Auto-generated - do not edit\n\n")
+	sb.WriteString("[dependencies]\n")
+	for _, c := range ranked {
+		sb.WriteString(fmt.Sprintf("# used by %d repos\n", len(c.repos)))
+		sb.WriteString(fmt.Sprintf("%s = %s\n", c.name, strconv.Quote(c.popularVersion())))
+	}
+	return sb.String()
+}
+
+// saveByCategory writes dir/{category}.toml for every category with at
+// least one used crate: the top crates of that category, ranked as in
+// most-common.toml. Category files from earlier runs that are no longer
+// produced are removed.
+func saveByCategory(dir string, owners []string, uses []DependencyUse, categories crateCategories, top int) error {
+	byCategory := make(map[string][]*crateStats)
+	var names []string
+	for _, c := range rankCrates(uses) {
+		category := categories.category(c.name)
+		if category == "" {
+			continue
+		}
+		if byCategory[category] == nil {
+			names = append(names, category)
+		}
+		byCategory[category] = append(byCategory[category], c)
+	}
+	sort.Strings(names)
+
+	written := make(map[string]bool)
+	for _, category := range names {
+		ranked := byCategory[category]
+		if top > 0 && len(ranked) > top {
+			ranked = ranked[:top]
+		}
+		path := filepath.Join(dir, safeSectionName(category)+".toml")
+		title := fmt.Sprintf("Most common %s dependencies across the %s organization repositories", category, strings.Join(owners, ", "))
+		if err := writeFile(path, []byte(rankedDependencies(title, ranked)), 0644); err != nil {
+			return err
+		}
+		written[path] = true
+	}
+
+	stale, _ := filepath.Glob(filepath.Join(dir, "*.toml"))
+	for _, path := range stale {
+		if !written[path] {
+			removeStale(path)
+		}
+	}
+	return nil
+}
+
+// saveSummaries writes the README for each output directory. A failed write
+// does not stop the remaining summaries; all failures are returned joined.
+func saveSummaries(outputDir, groupedDir, hashDir string, owners []string, stats Stats, hashRegistry HashRegistry,
+	duplicates int, dependencyUses []DependencyUse) error {
+	var errs []error
+	writeSummary := func(path, content string) {
+		if err := writeFile(path, []byte(content), 0644); err != nil {
+			errs = append(errs, fmt.Errorf("failed to write %s: %w", path, err))
+		}
+	}
+
+	// Save summary for main snippets
+	summaryPath := filepath.Join(outputDir, "README.md")
+	var sb strings.Builder
+	sb.WriteString("# Cargo Dependency Snippets\n\n")
+	sb.WriteString("This directory contains dependency sections extracted from Cargo.toml files\n")
+	sb.WriteString(fmt.Sprintf("across the %s organization repositories.\n\n", strings.Join(owners, ", ")))
+	sb.WriteString("## Usage\n\n")
+	sb.WriteString("These snippets can be used as templates for new Rust projects.\n")
 	sb.WriteString("Simply copy the relevant dependencies into your Cargo.toml file.\n\n")
 	sb.WriteString("For smaller, logically grouped snippets, see the `cargo-grouped/` directory.\n\n")
 	sb.WriteString("For deduplicated hash-based snippets, see the `cargo-hashed/` directory.\n\n")
@@ -566,10 +4041,15 @@ func saveSummaries(outputDir, groupedDir, hashDir string, stats Stats, hashRegis
 
 	sort.Strings(stats.ReposWithDeps)
 	for _, repo := range stats.ReposWithDeps {
-		sb.WriteString(fmt.Sprintf("- [%s](https://github.com/portal-co/%s)\n", repo, repo))
+		if strings.HasPrefix(repo, localOwner+"/") {
+			// -local pseudo-repositories have nothing to link to
+			sb.WriteString(fmt.Sprintf("- %s\n", repo))
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("- [%s](https://github.com/%s)\n", repo, repo))
 	}
 	sb.WriteString("\n*Generated automatically by download_cargo_deps.go*\n")
-	os.WriteFile(summaryPath, []byte(sb.String()), 0644)
+	writeSummary(summaryPath, sb.String())
 
 	// Save summary for grouped snippets
 	groupedSummaryPath := filepath.Join(groupedDir, "README.md")
@@ -578,7 +4058,7 @@ func saveSummaries(outputDir, groupedDir, hashDir string, stats Stats, hashRegis
 	sb.WriteString("This directory contains symlinks to deduplicated dependency snippets.\n")
 	sb.WriteString("Each symlink points to a hash-based file in `cargo-hashed/`.\n\n")
 	sb.WriteString("## Naming Convention\n\n")
-	sb.WriteString("Symlinks are named: `{repo}_{section}_group{NN}.toml`\n\n")
+	sb.WriteString(fmt.Sprintf("Symlinks are named: `{repo}_{section}_group{NN}%s`\n\n", snippetExt()))
 	sb.WriteString("Where:\n")
 	sb.WriteString("- `{repo}` is the repository name\n")
 	sb.WriteString("- `{section}` is the dependency section (e.g., `dependencies`, `workspace-dependencies`)\n")
@@ -589,7 +4069,7 @@ func saveSummaries(outputDir, groupedDir, hashDir string, stats Stats, hashRegis
 	sb.WriteString(fmt.Sprintf("Total grouped snippets: %d\n", stats.GroupsExtracted))
 	sb.WriteString(fmt.Sprintf("Unique content files: %d\n\n", stats.UniqueHashes))
 	sb.WriteString("\n*Generated automatically by download_cargo_deps.go*\n")
-	os.WriteFile(groupedSummaryPath, []byte(sb.String()), 0644)
+	writeSummary(groupedSummaryPath, sb.String())
 
 	// Save summary for hash-based snippets
 	hashSummaryPath := filepath.Join(hashDir, "README.md")
@@ -597,14 +4077,30 @@ func saveSummaries(outputDir, groupedDir, hashDir string, stats Stats, hashRegis
 	sb.WriteString("# Cargo Dependency Snippets (Hash-Based)\n\n")
 	sb.WriteString("This directory contains deduplicated dependency snippets identified by SHA256 hash.\n\n")
 	sb.WriteString("## Naming Convention\n\n")
-	sb.WriteString("Files are named: `{hash}.toml` where `{hash}` is the first 16 characters of the SHA256 hash.\n\n")
+	sb.WriteString(fmt.Sprintf("Files are named: `{hash}%s` where `{hash}` is the first 16 characters of the SHA256 hash.\n\n", snippetExt()))
 	sb.WriteString("## Deduplication\n\n")
 	sb.WriteString("Multiple repositories may share the same dependency groups.\n")
-	sb.WriteString("Each file contains a `# Sources:` comment listing all sources that share this content.\n\n")
+	sb.WriteString(fmt.Sprintf("Each `{hash}%s` holds only the dependency content; its `{hash}.json` sidecar\n", snippetExt()))
+	sb.WriteString("records the full hash and lists all sources that share this content.\n")
+	sb.WriteString("Hashes are computed over a canonical form with entries sorted by crate name and\n")
+	sb.WriteString("whitespace collapsed, so groups that differ only in declaration order share a file.\n\n")
 	sb.WriteString("## Usage\n\n")
 	sb.WriteString("Reference these files directly by hash for stable, content-addressable snippets.\n")
 	sb.WriteString("Or use the symlinks in `cargo-grouped/` for human-readable names.\n\n")
-	sb.WriteString(fmt.Sprintf("Total unique snippets: %d\n\n", stats.UniqueHashes))
+	sb.WriteString(fmt.Sprintf("Total unique snippets: %d\n", stats.UniqueHashes))
+	sb.WriteString(fmt.Sprintf("Dedup ratio: %.1f%% (%d grouped snippets share %d files)\n",
+		stats.DedupRatio*100, stats.GroupsExtracted, stats.UniqueHashes))
+	if stats.MostSharedSources > 1 {
+		sb.WriteString(fmt.Sprintf("Most shared snippet: `%s%s` (%d sources)\n", stats.MostSharedHash, snippetExt(), stats.MostSharedSources))
+	}
+	if stats.GroupedBytes > 0 {
+		sb.WriteString(fmt.Sprintf("Stored size: %d bytes for %d bytes of grouped snippets (%d bytes saved)\n",
+			stats.HashedBytes, stats.GroupedBytes, stats.GroupedBytes-stats.HashedBytes))
+	}
+	if stats.LargestSnippet != "" {
+		sb.WriteString(fmt.Sprintf("Largest snippet: `%s` from %s (%d bytes)\n", stats.LargestSnippet, stats.LargestSnippetSource, stats.LargestSnippetBytes))
+	}
+	sb.WriteString("\n")
 
 	if duplicates > 0 {
 		sb.WriteString("## Shared Snippets\n\n")
@@ -621,7 +4117,7 @@ func saveSummaries(outputDir, groupedDir, hashDir string, stats Stats, hashRegis
 
 		for _, hash := range hashes {
 			sources := hashRegistry[hash]
-			sb.WriteString(fmt.Sprintf("### `%s.toml`\n", hash))
+			sb.WriteString(fmt.Sprintf("### `%s%s`\n", hash, snippetExt()))
 			sort.Strings(sources)
 			for _, source := range sources {
 				sb.WriteString(fmt.Sprintf("- %s\n", source))
@@ -631,5 +4127,792 @@ func saveSummaries(outputDir, groupedDir, hashDir string, stats Stats, hashRegis
 	}
 
 	sb.WriteString("\n*Generated automatically by download_cargo_deps.go*\n")
-	os.WriteFile(hashSummaryPath, []byte(sb.String()), 0644)
+	writeSummary(hashSummaryPath, sb.String())
+
+	// Save the version conflicts report
+	writeSummary(filepath.Join(outputDir, "version-conflicts.md"), versionConflictsReport(dependencyUses))
+
+	// Save the git dependencies report
+	writeSummary(filepath.Join(outputDir, "git-dependencies.md"), gitDependenciesReport(dependencyUses))
+
+	// Save the per-crate usage report
+	writeSummary(filepath.Join(outputDir, "crate-usage.md"), crateUsageReport(dependencyUses))
+
+	return errors.Join(errs...)
+}
+
+// duplicateDeclarations returns the crates declared more than once in the
+// same section of uses, one manifest's dependencies, sorted by section and
+// name. Cargo rejects such manifests; they usually come from a bad merge.
+func duplicateDeclarations(uses []DependencyUse) [][]DependencyUse {
+	type key struct{ section, name string }
+	bySection := make(map[key][]DependencyUse)
+	var keys []key
+	for _, use := range uses {
+		k := key{use.Section, use.Name}
+		if bySection[k] == nil {
+			keys = append(keys, k)
+		}
+		bySection[k] = append(bySection[k], use)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].section != keys[j].section {
+			return keys[i].section < keys[j].section
+		}
+		return keys[i].name < keys[j].name
+	})
+
+	var duplicates [][]DependencyUse
+	for _, k := range keys {
+		if len(bySection[k]) > 1 {
+			duplicates = append(duplicates, bySection[k])
+		}
+	}
+	return duplicates
+}
+
+// malformedReport lists, per source, the crates declared more than once
+// within one section, with what each declaration pins.
+func malformedReport(sources map[string]*ManifestSource) string {
+	var ids []string
+	for id, source := range sources {
+		if len(duplicateDeclarations(source.Dependencies)) > 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	var sb strings.Builder
+	sb.WriteString("# Malformed Manifests\n\n")
+	sb.WriteString("Crates declared more than once in the same section of a Cargo.toml,\n")
+	sb.WriteString("usually left behind by a merge. Cargo refuses to build these manifests.\n\n")
+	sb.WriteString(fmt.Sprintf("Manifests with duplicate declarations: %d\n\n", len(ids)))
+
+	for _, id := range ids {
+		sb.WriteString(fmt.Sprintf("## %s\n\n", id))
+		for _, decls := range duplicateDeclarations(sources[id].Dependencies) {
+			var pins []string
+			for _, use := range decls {
+				pins = append(pins, dependencyPin(use))
+			}
+			sb.WriteString(fmt.Sprintf("- `%s` ([%s]): %s\n", decls[0].Name, decls[0].Section, strings.Join(pins, ", ")))
+		}
+		sb.WriteString("\n")
+	}
+
+	sb.WriteString("\n*Generated automatically by download_cargo_deps.go*\n")
+	return sb.String()
+}
+
+// gitDependenciesReport lists, per repository, every dependency fetched
+// from git rather than a registry, with its URL and pinned revision.
+func gitDependenciesReport(uses []DependencyUse) string {
+	byRepo := make(map[string][]DependencyUse)
+	for _, use := range uses {
+		if use.Git != "" {
+			byRepo[use.Repo] = append(byRepo[use.Repo], use)
+		}
+	}
+
+	var repos []string
+	for repo := range byRepo {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+
+	var sb strings.Builder
+	sb.WriteString("# Git Dependencies\n\n")
+	sb.WriteString("Dependencies fetched from a git repository instead of crates.io.\n")
+	sb.WriteString("Snippets containing them need the git reference to build elsewhere.\n\n")
+	sb.WriteString(fmt.Sprintf("Repositories with git dependencies: %d\n\n", len(repos)))
+
+	for _, repo := range repos {
+		sb.WriteString(fmt.Sprintf("## %s\n\n", repo))
+		deps := byRepo[repo]
+		sort.SliceStable(deps, func(i, j int) bool {
+			if deps[i].Name != deps[j].Name {
+				return deps[i].Name < deps[j].Name
+			}
+			return deps[i].Section < deps[j].Section
+		})
+		for _, use := range deps {
+			line := fmt.Sprintf("- `%s` ([%s]): %s", use.Name, use.Section, use.Git)
+			if use.GitRef != "" {
+				line += fmt.Sprintf(" (%s)", use.GitRef)
+			}
+			sb.WriteString(line + "\n")
+		}
+		sb.WriteString("\n")
+	}
+
+	sb.WriteString("\n*Generated automatically by download_cargo_deps.go*\n")
+	return sb.String()
+}
+
+// changesReport compares the hashed snippets of this run, in hashRegistry,
+// with those of the previous manifest: snippets that are new, snippets that
+// are gone, and snippets whose sources changed.
+func changesReport(previous Manifest, hashRegistry HashRegistry) string {
+	before := make(map[string][]string, len(previous.Snippets))
+	for _, entry := range previous.Snippets {
+		before[entry.ShortHash] = entry.Sources
+	}
+
+	var added, removed, changed []string
+	for hash := range hashRegistry {
+		if _, ok := before[hash]; !ok {
+			added = append(added, hash)
+		}
+	}
+	for hash, sources := range before {
+		current, ok := hashRegistry[hash]
+		if !ok {
+			removed = append(removed, hash)
+		} else if gained, lost := diffSources(sources, current); len(gained)+len(lost) > 0 {
+			changed = append(changed, hash)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+
+	var sb strings.Builder
+	sb.WriteString("# Changes\n\n")
+	if len(previous.Snippets) == 0 {
+		sb.WriteString("No previous manifest.json was found, so every snippet is listed as added.\n\n")
+	} else {
+		sb.WriteString("Hashed snippets added, removed or re-sourced since the previous run.\n\n")
+	}
+	sb.WriteString(fmt.Sprintf("Added: %d, removed: %d, changed sources: %d\n\n", len(added), len(removed), len(changed)))
+
+	writeHashes := func(title string, hashes []string, registry map[string][]string) {
+		if len(hashes) == 0 {
+			return
+		}
+		sb.WriteString(fmt.Sprintf("## %s\n\n", title))
+		for _, hash := range hashes {
+			sources := append([]string(nil), registry[hash]...)
+			sort.Strings(sources)
+			sb.WriteString(fmt.Sprintf("- `%s%s`: %s\n", hash, snippetExt(), strings.Join(sources, ", ")))
+		}
+		sb.WriteString("\n")
+	}
+	writeHashes("Added snippets", added, hashRegistry)
+	writeHashes("Removed snippets", removed, before)
+
+	if len(changed) > 0 {
+		sb.WriteString("## Changed sources\n\n")
+		for _, hash := range changed {
+			gained, lost := diffSources(before[hash], hashRegistry[hash])
+			sb.WriteString(fmt.Sprintf("### `%s%s`\n", hash, snippetExt()))
+			for _, source := range gained {
+				sb.WriteString(fmt.Sprintf("- added %s\n", source))
+			}
+			for _, source := range lost {
+				sb.WriteString(fmt.Sprintf("- removed %s\n", source))
+			}
+			sb.WriteString("\n")
+		}
+	}
+
+	sb.WriteString("\n*Generated automatically by download_cargo_deps.go*\n")
+	return sb.String()
+}
+
+// diffSources returns the sources in current but not before, and those in
+// before but not current, both sorted.
+func diffSources(before, current []string) (gained, lost []string) {
+	inBefore := make(map[string]bool, len(before))
+	for _, source := range before {
+		inBefore[source] = true
+	}
+	inCurrent := make(map[string]bool, len(current))
+	for _, source := range current {
+		inCurrent[source] = true
+		if !inBefore[source] {
+			gained = append(gained, source)
+		}
+	}
+	for _, source := range before {
+		if !inCurrent[source] {
+			lost = append(lost, source)
+		}
+	}
+	sort.Strings(gained)
+	sort.Strings(lost)
+	return gained, lost
+}
+
+// crateUsageReport lists, per crate, the repositories that declare it and
+// what each one pins it to. Renamed dependencies are listed under the crate
+// they rename.
+func crateUsageReport(uses []DependencyUse) string {
+	// crate -> repo -> declarations
+	usage := make(map[string]map[string][]DependencyUse)
+	for _, use := range uses {
+		name := use.crate()
+		if usage[name] == nil {
+			usage[name] = make(map[string][]DependencyUse)
+		}
+		usage[name][use.Repo] = append(usage[name][use.Repo], use)
+	}
+
+	var crates []string
+	for name := range usage {
+		crates = append(crates, name)
+	}
+	sort.Strings(crates)
+
+	var sb strings.Builder
+	sb.WriteString("# Crate Usage\n\n")
+	sb.WriteString("Repositories that declare each crate, with the version each one pins.\n")
+	sb.WriteString("Check here before a breaking upgrade to see who is affected.\n\n")
+	sb.WriteString(fmt.Sprintf("Crates: %d\n\n", len(crates)))
+
+	for _, name := range crates {
+		sb.WriteString(fmt.Sprintf("## `%s`\n\n", name))
+		var repos []string
+		for repo := range usage[name] {
+			repos = append(repos, repo)
+		}
+		sort.Strings(repos)
+		for _, repo := range repos {
+			decls := usage[name][repo]
+			sort.SliceStable(decls, func(i, j int) bool {
+				return decls[i].Section < decls[j].Section
+			})
+			var pins []string
+			for _, use := range decls {
+				pin := fmt.Sprintf("%s ([%s])", dependencyPin(use), use.Section)
+				if len(use.Comments) > 0 {
+					pin += fmt.Sprintf(" — %s", strings.Join(use.Comments, " "))
+				}
+				pins = append(pins, pin)
+			}
+			sb.WriteString(fmt.Sprintf("- %s: %s\n", repo, strings.Join(pins, ", ")))
+		}
+		sb.WriteString("\n")
+	}
+
+	sb.WriteString("\n*Generated automatically by download_cargo_deps.go*\n")
+	return sb.String()
+}
+
+// diffRepoDependencies downloads the root Cargo.toml of the two repositories
+// in specs and writes the differences between their dependencies to w, one
+// hunk per section: crates only in the first as "-" lines, crates only in
+// the second as "+" lines, and crates declared differently in both as a "-"
+// and a "+" line. Specs without an owner belong to owner.
+func diffRepoDependencies(w io.Writer, specs []string, owner string) error {
+	if len(specs) != 2 {
+		return fmt.Errorf("-diff wants two repositories, got %d", len(specs))
+	}
+	var repos [2]RepoInfo
+	var uses [2][]DependencyUse
+	for i, spec := range specs {
+		if !strings.Contains(strings.SplitN(spec, "@", 2)[0], "/") {
+			spec = owner + "/" + spec
+		}
+		repo, err := parseRepoSpec(spec)
+		if err != nil {
+			return fmt.Errorf("-diff: %w", err)
+		}
+		content, _, _, err := downloadCargoToml(repo.Owner(), repo.Name, repo.DefaultBranch, "Cargo.toml", nil, "")
+		if err != nil {
+			return fmt.Errorf("downloading Cargo.toml: %w", err)
+		}
+		sections := extractDependencySections(skipLeadingJunk(repo.FullName, content))
+		workspace := workspaceDependencies(sections)
+		for _, sectionName := range sortedSectionNames(sections) {
+			if cargosnip.DeclaresDependencies(sectionName) {
+				groups := cargosnip.SplitByBlankLines(sections[sectionName])
+				uses[i] = append(uses[i], collectDependencyUses(repo.FullName, sectionName, groups, workspace)...)
+			}
+		}
+		repos[i] = repo
+	}
+
+	_, err := io.WriteString(w, dependencyDiff(repos[0].FullName, repos[1].FullName, uses[0], uses[1]))
+	return err
+}
+
+// dependencyDiff renders the differences between the dependency uses a and
+// b of the repositories nameA and nameB. Dependencies are compared by
+// section and name, and are equal when dependencyPin describes them the
+// same way.
+func dependencyDiff(nameA, nameB string, a, b []DependencyUse) string {
+	type key struct{ section, name string }
+	index := func(uses []DependencyUse) map[key]DependencyUse {
+		m := make(map[key]DependencyUse)
+		for _, use := range uses {
+			m[key{use.Section, use.Name}] = use
+		}
+		return m
+	}
+	inA, inB := index(a), index(b)
+
+	var keys []key
+	for k := range inA {
+		keys = append(keys, k)
+	}
+	for k := range inB {
+		if _, ok := inA[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].section != keys[j].section {
+			return keys[i].section < keys[j].section
+		}
+		return keys[i].name < keys[j].name
+	})
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("--- %s\n+++ %s\n", nameA, nameB))
+	onlyA, onlyB, changed, same := 0, 0, 0, 0
+	section := ""
+	for _, k := range keys {
+		useA, okA := inA[k]
+		useB, okB := inB[k]
+		if okA && okB && dependencyPin(useA) == dependencyPin(useB) {
+			same++
+			continue
+		}
+		if k.section != section {
+			section = k.section
+			sb.WriteString(fmt.Sprintf("@@ [%s] @@\n", section))
+		}
+		switch {
+		case !okB:
+			onlyA++
+		case !okA:
+			onlyB++
+		default:
+			changed++
+		}
+		if okA {
+			sb.WriteString(fmt.Sprintf("-%s %s\n", k.name, dependencyPin(useA)))
+		}
+		if okB {
+			sb.WriteString(fmt.Sprintf("+%s %s\n", k.name, dependencyPin(useB)))
+		}
+	}
+	sb.WriteString(fmt.Sprintf("\n%d only in %s, %d only in %s, %d declared differently, %d identical\n",
+		onlyA, nameA, onlyB, nameB, changed, same))
+	return sb.String()
+}
+
+// dependencyPin describes where a declared dependency comes from: its
+// version requirement, git source or local path.
+func dependencyPin(use DependencyUse) string {
+	switch {
+	case use.Git != "" && use.GitRef != "":
+		return fmt.Sprintf("git %s (%s)", use.Git, use.GitRef)
+	case use.Git != "":
+		return "git " + use.Git
+	case use.Path != "":
+		return fmt.Sprintf("path `%s`", use.Path)
+	case use.Version != "":
+		return fmt.Sprintf("`%s`", use.Version)
+	default:
+		return "no version"
+	}
+}
+
+// cratesIOBase is the root of the crates.io crate API.
+const cratesIOBase = "https://crates.io/api/v1/crates"
+
+// cratesIOInterval is the minimum delay between crates.io requests, per the
+// crates.io crawler policy of at most one request per second.
+const cratesIOInterval = time.Second
+
+// cratesIOClient queries crates.io politely: requests are spaced by
+// cratesIOInterval, carry a User-Agent with a contact URL, and each crate is
+// looked up at most once per run. It is safe for concurrent use; lookupAll
+// runs up to workers lookups at a time, which overlaps slow responses without
+// raising the request rate.
+type cratesIOClient struct {
+	client  *http.Client
+	workers int
+
+	mu     sync.Mutex
+	next   time.Time // earliest start of the next request
+	crates map[string]*crateInfo
+}
+
+// crateInfo is what crates.io reported for one crate.
+type crateInfo struct {
+	exists bool
+	yanked map[string]bool // published version -> whether it is yanked
+}
+
+// cratesIOCrate is the part of a crates.io crate response that is used.
+type cratesIOCrate struct {
+	Versions []struct {
+		Num    string `json:"num"`
+		Yanked bool   `json:"yanked"`
+	} `json:"versions"`
+}
+
+func newCratesIOClient(workers int) *cratesIOClient {
+	return &cratesIOClient{
+		client:  &http.Client{Transport: httpTransport, Timeout: 30 * time.Second},
+		workers: workers,
+		crates:  make(map[string]*crateInfo),
+	}
+}
+
+// lookupAll looks up every crate in names, c.workers at a time, and returns
+// the errors of the lookups that failed.
+func (c *cratesIOClient) lookupAll(names []string) map[string]error {
+	jobs := make(chan string)
+	errs := make(map[string]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < c.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range jobs {
+				if _, err := c.lookup(name); err != nil {
+					mu.Lock()
+					errs[name] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, name := range names {
+		jobs <- name
+	}
+	close(jobs)
+	wg.Wait()
+	return errs
+}
+
+// crateExists reports whether name is published on crates.io.
+func (c *cratesIOClient) crateExists(name string) (bool, error) {
+	info, err := c.lookup(name)
+	if err != nil {
+		return false, err
+	}
+	return info.exists, nil
+}
+
+// versionYanked reports whether version of name is yanked. Versions
+// crates.io does not know are not yanked.
+func (c *cratesIOClient) versionYanked(name, version string) (bool, error) {
+	info, err := c.lookup(name)
+	if err != nil {
+		return false, err
+	}
+	return info.yanked[version], nil
+}
+
+// lookup fetches the crate and version metadata of name. A 404 means the
+// crate does not exist; any other failure is returned as an error and not
+// cached.
+func (c *cratesIOClient) lookup(name string) (*crateInfo, error) {
+	c.mu.Lock()
+	if info, ok := c.crates[name]; ok {
+		c.mu.Unlock()
+		return info, nil
+	}
+	start := time.Now()
+	if c.next.After(start) {
+		start = c.next
+	}
+	c.next = start.Add(cratesIOInterval)
+	c.mu.Unlock()
+	time.Sleep(time.Until(start))
+
+	req, err := http.NewRequest("GET", cratesIOBase+"/"+url.PathEscape(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	info := &crateInfo{yanked: make(map[string]bool)}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var crate cratesIOCrate
+		if err := json.NewDecoder(resp.Body).Decode(&crate); err != nil {
+			return nil, fmt.Errorf("decoding crates.io response for %s: %w", name, err)
+		}
+		info.exists = true
+		for _, v := range crate.Versions {
+			info.yanked[v.Num] = v.Yanked
+		}
+	case http.StatusNotFound:
+		io.Copy(io.Discard, resp.Body)
+	default:
+		io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("crates.io returned HTTP %d for %s", resp.StatusCode, name)
+	}
+	c.mu.Lock()
+	c.crates[name] = info
+	c.mu.Unlock()
+	return info, nil
+}
+
+// findMissingCrates looks up every registry crate in uses and returns the
+// ones crates.io does not know, mapped to the repositories referencing them.
+// Crates whose lookup fails are logged and left out.
+func findMissingCrates(client *cratesIOClient, uses []DependencyUse) map[string][]string {
+	reposByCrate := make(map[string]map[string]bool)
+	for _, use := range uses {
+		name := use.registryCrate()
+		if name == "" {
+			continue
+		}
+		if reposByCrate[name] == nil {
+			reposByCrate[name] = make(map[string]bool)
+		}
+		reposByCrate[name][use.Repo] = true
+	}
+
+	var names []string
+	for name := range reposByCrate {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	slog.Info("verifying crates on crates.io", "crates", len(names))
+	errs := client.lookupAll(names)
+	missing := make(map[string][]string)
+	for _, name := range names {
+		if err := errs[name]; err != nil {
+			slog.Warn("crate lookup failed", "crate", name, "err", err)
+			continue
+		}
+		// Cached by lookupAll, so this cannot fail
+		if exists, _ := client.crateExists(name); exists {
+			continue
+		}
+		for repo := range reposByCrate[name] {
+			missing[name] = append(missing[name], repo)
+		}
+		sort.Strings(missing[name])
+	}
+	return missing
+}
+
+// missingCratesReport lists crates that crates.io does not know, with the
+// repositories that reference them.
+func missingCratesReport(missing map[string][]string) string {
+	var names []string
+	for name := range missing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString("# Missing Crates\n\n")
+	sb.WriteString("Registry dependencies that crates.io does not know: typos, renamed crates,\n")
+	sb.WriteString("or internal crates that were never published. Git and path dependencies are not checked.\n\n")
+	sb.WriteString(fmt.Sprintf("Missing crates: %d\n\n", len(names)))
+
+	for _, name := range names {
+		sb.WriteString(fmt.Sprintf("- `%s`: %s\n", name, strings.Join(missing[name], ", ")))
+	}
+
+	sb.WriteString("\n*Generated automatically by download_cargo_deps.go*\n")
+	return sb.String()
+}
+
+// exactVersion returns the version an "=x.y.z" requirement pins, or "" when
+// req allows more than one version.
+func exactVersion(req string) string {
+	version, ok := strings.CutPrefix(strings.TrimSpace(req), "=")
+	version = strings.TrimSpace(version)
+	if !ok || version == "" || strings.ContainsAny(version, ",*<>=^~ ") || strings.Count(version, ".") < 2 {
+		return ""
+	}
+	return version
+}
+
+// findYankedPins returns the registry dependencies in uses whose exact
+// version pin is yanked on crates.io, ordered by repository, crate and
+// section. Each crate is looked up once; failed lookups are logged and left
+// out.
+func findYankedPins(client *cratesIOClient, uses []DependencyUse) []DependencyUse {
+	var pinned []DependencyUse
+	var names []string
+	seen := make(map[string]bool)
+	for _, use := range uses {
+		name := use.registryCrate()
+		if name == "" || exactVersion(use.Version) == "" {
+			continue
+		}
+		pinned = append(pinned, use)
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	errs := client.lookupAll(names)
+	for _, name := range names {
+		if err := errs[name]; err != nil {
+			slog.Warn("crate lookup failed", "crate", name, "err", err)
+		}
+	}
+
+	var yanked []DependencyUse
+	for _, use := range pinned {
+		if errs[use.registryCrate()] != nil {
+			continue
+		}
+		if isYanked, _ := client.versionYanked(use.registryCrate(), exactVersion(use.Version)); isYanked {
+			yanked = append(yanked, use)
+		}
+	}
+	sort.SliceStable(yanked, func(i, j int) bool {
+		a, b := yanked[i], yanked[j]
+		if a.Repo != b.Repo {
+			return a.Repo < b.Repo
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Section < b.Section
+	})
+	return yanked
+}
+
+// yankedDependenciesReport lists dependencies pinned to a yanked version.
+func yankedDependenciesReport(yanked []DependencyUse) string {
+	var sb strings.Builder
+	sb.WriteString("# Yanked Dependencies\n\n")
+	sb.WriteString("Dependencies pinned with an exact `=` requirement to a version that is yanked on crates.io.\n")
+	sb.WriteString("Other requirements are not checked, since Cargo can pick a newer release.\n\n")
+	sb.WriteString(fmt.Sprintf("Yanked pins: %d\n\n", len(yanked)))
+
+	for _, use := range yanked {
+		sb.WriteString(fmt.Sprintf("- %s: `%s` %s ([%s])\n", use.Repo, use.registryCrate(), exactVersion(use.Version), use.Section))
+	}
+
+	sb.WriteString("\n*Generated automatically by download_cargo_deps.go*\n")
+	return sb.String()
+}
+
+// resolvedVersionsReport lists, per crate, the versions Cargo.lock resolved
+// it to in each repository that declares it directly. resolved maps a
+// repository to its locked packages; a crate may be locked at several
+// versions in one repository. Cargo.lock records renamed dependencies under
+// their package name, so that is what declarations are matched on.
+func resolvedVersionsReport(uses []DependencyUse, resolved map[string][]LockedPackage) string {
+	// crate -> resolved version -> repos
+	versions := make(map[string]map[string]map[string]bool)
+	for _, use := range uses {
+		name := use.crate()
+		for _, pkg := range resolved[use.Repo] {
+			if pkg.Name != name || pkg.Version == "" {
+				continue
+			}
+			if versions[pkg.Name] == nil {
+				versions[pkg.Name] = make(map[string]map[string]bool)
+			}
+			if versions[pkg.Name][pkg.Version] == nil {
+				versions[pkg.Name][pkg.Version] = make(map[string]bool)
+			}
+			versions[pkg.Name][pkg.Version][use.Repo] = true
+		}
+	}
+
+	var crates []string
+	for name := range versions {
+		crates = append(crates, name)
+	}
+	sort.Strings(crates)
+
+	var sb strings.Builder
+	sb.WriteString("# Resolved Versions\n\n")
+	sb.WriteString("Concrete versions locked in each repository's Cargo.lock for the crates it depends on directly.\n\n")
+	sb.WriteString(fmt.Sprintf("Repositories with a Cargo.lock: %d\n", len(resolved)))
+	sb.WriteString(fmt.Sprintf("Crates resolved: %d\n\n", len(crates)))
+
+	for _, name := range crates {
+		sb.WriteString(fmt.Sprintf("## `%s`\n\n", name))
+		var vs []string
+		for v := range versions[name] {
+			vs = append(vs, v)
+		}
+		sort.Strings(vs)
+		for _, v := range vs {
+			var repos []string
+			for repo := range versions[name][v] {
+				repos = append(repos, repo)
+			}
+			sort.Strings(repos)
+			sb.WriteString(fmt.Sprintf("- `%s`: %s\n", v, strings.Join(repos, ", ")))
+		}
+		sb.WriteString("\n")
+	}
+
+	sb.WriteString("\n*Generated automatically by download_cargo_deps.go*\n")
+	return sb.String()
+}
+
+// versionConflictsReport lists crates declared with more than one distinct
+// version requirement, and which repos use each requirement. Renamed
+// dependencies are grouped with the crate they rename.
+func versionConflictsReport(uses []DependencyUse) string {
+	// crate -> requirement -> repos
+	requirements := make(map[string]map[string]map[string]bool)
+	for _, use := range uses {
+		if use.Version == "" {
+			continue
+		}
+		name := use.crate()
+		if requirements[name] == nil {
+			requirements[name] = make(map[string]map[string]bool)
+		}
+		if requirements[name][use.Version] == nil {
+			requirements[name][use.Version] = make(map[string]bool)
+		}
+		requirements[name][use.Version][use.Repo] = true
+	}
+
+	var crates []string
+	for name, versions := range requirements {
+		if len(versions) > 1 {
+			crates = append(crates, name)
+		}
+	}
+	sort.Strings(crates)
+
+	var sb strings.Builder
+	sb.WriteString("# Version Conflicts\n\n")
+	sb.WriteString("Crates that are declared with more than one version requirement across repositories.\n")
+	sb.WriteString("These are candidates for coordinated upgrades.\n\n")
+	sb.WriteString(fmt.Sprintf("Crates with conflicting requirements: %d\n\n", len(crates)))
+
+	for _, name := range crates {
+		sb.WriteString(fmt.Sprintf("## `%s`\n\n", name))
+		var versions []string
+		for v := range requirements[name] {
+			versions = append(versions, v)
+		}
+		sort.Strings(versions)
+		for _, v := range versions {
+			var repos []string
+			for repo := range requirements[name][v] {
+				repos = append(repos, repo)
+			}
+			sort.Strings(repos)
+			sb.WriteString(fmt.Sprintf("- `%s`: %s\n", v, strings.Join(repos, ", ")))
+		}
+		sb.WriteString("\n")
+	}
+
+	sb.WriteString("\n*Generated automatically by download_cargo_deps.go*\n")
+	return sb.String()
 }
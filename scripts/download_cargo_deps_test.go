@@ -0,0 +1,737 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/portal-co/rice-snippets/cargosnip"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	retryBaseDelay = time.Millisecond
+	os.Exit(m.Run())
+}
+
+// fakeGitHub points apiBase and rawBase at test servers running api and
+// raw, and restores them when the test ends.
+func fakeGitHub(t *testing.T, api, raw http.HandlerFunc) (apiServer, rawServer *httptest.Server) {
+	t.Helper()
+	apiServer = httptest.NewServer(api)
+	rawServer = httptest.NewServer(raw)
+	oldAPI, oldRaw := apiBase, rawBase
+	apiBase, rawBase = apiServer.URL, rawServer.URL
+	t.Cleanup(func() {
+		apiServer.Close()
+		rawServer.Close()
+		apiBase, rawBase = oldAPI, oldRaw
+	})
+	return apiServer, rawServer
+}
+
+// writeJSON writes v, which must already be JSON text, as the response.
+func writeJSON(w http.ResponseWriter, v string) {
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, v)
+}
+
+func notFound(w http.ResponseWriter, r *http.Request) {
+	http.NotFound(w, r)
+}
+
+func repoNames(repos []RepoInfo) string {
+	var names []string
+	for _, repo := range repos {
+		names = append(names, repo.FullName)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestDiscoverRustReposFollowsLinkPagination(t *testing.T) {
+	var api *httptest.Server
+	api, _ = fakeGitHub(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/users/acme":
+			writeJSON(w, `{"login": "acme", "type": "Organization"}`)
+		case r.URL.Path == "/search/repositories" && r.URL.Query().Get("page") == "1":
+			if q := r.URL.Query().Get("q"); q != "org:acme language:Rust" {
+				t.Errorf("search query = %q, want org:acme language:Rust", q)
+			}
+			w.Header().Set("Link", fmt.Sprintf(`<%s/search/repositories?q=org:acme&page=2>; rel="next", <%s/search/repositories?q=org:acme&page=2>; rel="last"`, api.URL, api.URL))
+			writeJSON(w, `{"total_count": 3, "items": [{"name": "a", "full_name": "acme/a"}, {"name": "b", "full_name": "acme/b"}]}`)
+		case r.URL.Path == "/search/repositories" && r.URL.Query().Get("page") == "2":
+			w.Header().Set("Link", fmt.Sprintf(`<%s/search/repositories?q=org:acme&page=1>; rel="prev"`, api.URL))
+			writeJSON(w, `{"total_count": 3, "items": [{"name": "c", "full_name": "acme/c"}]}`)
+		default:
+			t.Errorf("unexpected request %s", r.URL)
+			http.NotFound(w, r)
+		}
+	}, notFound)
+
+	repos, _, err := discoverRustRepos("acme", 2, DiscoveryFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := repoNames(repos), "acme/a,acme/b,acme/c"; got != want {
+		t.Errorf("repos = %s, want %s", got, want)
+	}
+}
+
+func TestDiscoverRustReposListsRepositoriesOverSearchCap(t *testing.T) {
+	var api *httptest.Server
+	var searches int
+	api, _ = fakeGitHub(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/users/acme":
+			writeJSON(w, `{"login": "acme", "type": "Organization"}`)
+		case r.URL.Path == "/search/repositories":
+			searches++
+			w.Header().Set("Link", fmt.Sprintf(`<%s/search/repositories?page=2>; rel="next"`, api.URL))
+			writeJSON(w, fmt.Sprintf(`{"total_count": %d, "items": [{"name": "a", "full_name": "acme/a"}]}`, searchResultCap+1))
+		case r.URL.Path == "/orgs/acme/repos" && r.URL.Query().Get("page") == "1":
+			if got := r.URL.Query().Get("type"); got != "sources" {
+				t.Errorf("listing type = %q, want sources", got)
+			}
+			w.Header().Set("Link", fmt.Sprintf(`<%s/orgs/acme/repos?type=sources&page=2>; rel="next"`, api.URL))
+			writeJSON(w, `[{"name": "a", "full_name": "acme/a", "language": "Rust"}, {"name": "web", "full_name": "acme/web", "language": "Go"}]`)
+		case r.URL.Path == "/orgs/acme/repos" && r.URL.Query().Get("page") == "2":
+			writeJSON(w, `[{"name": "z", "full_name": "acme/z", "language": "Rust", "archived": true}, {"name": "y", "full_name": "acme/y", "language": "Rust"}]`)
+		default:
+			t.Errorf("unexpected request %s", r.URL)
+			http.NotFound(w, r)
+		}
+	}, notFound)
+
+	repos, skipped, err := discoverRustRepos("acme", 2, DiscoveryFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if searches != 1 {
+		t.Errorf("search pages fetched = %d, want 1 once the cap is exceeded", searches)
+	}
+	if got, want := repoNames(repos), "acme/a,acme/y"; got != want {
+		t.Errorf("repos = %s, want %s", got, want)
+	}
+	if skipped.Archived != 1 {
+		t.Errorf("skipped archived = %d, want 1", skipped.Archived)
+	}
+}
+
+func TestDiscoverRustReposForUserAccount(t *testing.T) {
+	fakeGitHub(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/users/someone":
+			writeJSON(w, `{"login": "someone", "type": "User"}`)
+		case "/search/repositories":
+			if q := r.URL.Query().Get("q"); q != "user:someone language:Rust" {
+				t.Errorf("search query = %q, want user:someone language:Rust", q)
+			}
+			writeJSON(w, fmt.Sprintf(`{"total_count": %d, "items": []}`, searchResultCap+1))
+		case "/users/someone/repos":
+			writeJSON(w, `[{"name": "a", "full_name": "someone/a", "language": "Rust"}, {"name": "f", "full_name": "someone/f", "language": "Rust", "fork": true}]`)
+		default:
+			t.Errorf("unexpected request %s", r.URL)
+			http.NotFound(w, r)
+		}
+	}, notFound)
+
+	repos, skipped, err := discoverRustRepos("someone", 100, DiscoveryFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := repoNames(repos), "someone/a"; got != want {
+		t.Errorf("repos = %s, want %s", got, want)
+	}
+	if skipped.Forks != 1 {
+		t.Errorf("skipped forks = %d, want 1", skipped.Forks)
+	}
+}
+
+func TestDownloadCargoTomlFallsBackToNextBranch(t *testing.T) {
+	fakeGitHub(t, notFound, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/acme/a/master/Cargo.toml" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "[dependencies]\nserde = \"1\"\n")
+	})
+
+	content, branch, _, err := downloadCargoToml("acme", "a", "main", "Cargo.toml", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if branch != "master" {
+		t.Errorf("branch = %q, want master", branch)
+	}
+	if content != "[dependencies]\nserde = \"1\"\n" {
+		t.Errorf("content = %q", content)
+	}
+
+	_, _, _, err = downloadCargoToml("acme", "b", "main", "Cargo.toml", nil, "")
+	if !errors.Is(err, errNotFound) {
+		t.Errorf("missing manifest: err = %v, want errNotFound", err)
+	}
+}
+
+func TestCandidateBranches(t *testing.T) {
+	old := fallbackBranches
+	defer func() { fallbackBranches = old }()
+	fallbackBranches = []string{"main", "master"}
+
+	for _, tt := range []struct {
+		branch string
+		want   string
+	}{
+		{"main", "main,master"},
+		{"master", "master,main"},
+		{"develop", "develop,main,master"},
+	} {
+		if got := strings.Join(candidateBranches(tt.branch), ","); got != tt.want {
+			t.Errorf("candidateBranches(%q) = %s, want %s", tt.branch, got, tt.want)
+		}
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	unauthorized := func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Bad credentials", http.StatusUnauthorized)
+	}
+	fakeGitHub(t, unauthorized, unauthorized)
+
+	if _, _, err := discoverRustRepos("acme", 100, DiscoveryFilter{}); !errors.Is(err, errUnauthorized) {
+		t.Errorf("discoverRustRepos: err = %v, want errUnauthorized", err)
+	}
+	if _, err := listCargoTomlPaths("acme", "a", "main"); !errors.Is(err, errUnauthorized) {
+		t.Errorf("listCargoTomlPaths: err = %v, want errUnauthorized", err)
+	}
+	if _, _, _, err := downloadCargoToml("acme", "a", "main", "Cargo.toml", nil, ""); !errors.Is(err, errUnauthorized) {
+		t.Errorf("downloadCargoToml: err = %v, want errUnauthorized", err)
+	}
+}
+
+func TestDownloadCargoTomlRetriesServerErrors(t *testing.T) {
+	oldRetries := retries
+	defer func() { retries = oldRetries }()
+	retries = 2
+
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	fakeGitHub(t, notFound, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts[r.URL.Path]++
+		n := attempts[r.URL.Path]
+		mu.Unlock()
+		// acme/flaky recovers on the third attempt, acme/down never does
+		if strings.HasPrefix(r.URL.Path, "/acme/down/") || n < 3 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "[dependencies]\n")
+	})
+
+	if _, _, _, err := downloadCargoToml("acme", "flaky", "main", "Cargo.toml", nil, ""); err != nil {
+		t.Errorf("flaky: %v", err)
+	}
+	if got := attempts["/acme/flaky/main/Cargo.toml"]; got != 3 {
+		t.Errorf("flaky: %d attempts, want 3", got)
+	}
+
+	_, _, _, err := downloadCargoToml("acme", "down", "main", "Cargo.toml", nil, "")
+	if err == nil || !strings.Contains(err.Error(), "HTTP 503") {
+		t.Errorf("down: err = %v, want HTTP 503", err)
+	}
+	// A 5xx is not a 404, so no fallback branch is tried
+	if got := attempts["/acme/down/main/Cargo.toml"]; got != retries+1 {
+		t.Errorf("down: %d attempts, want %d", got, retries+1)
+	}
+	if got := attempts["/acme/down/master/Cargo.toml"]; got != 0 {
+		t.Errorf("down: %d attempts on master, want 0", got)
+	}
+}
+
+func TestRetryDelayDoublesWithJitter(t *testing.T) {
+	for attempt := 0; attempt < 4; attempt++ {
+		base := retryBaseDelay << attempt
+		for i := 0; i < 20; i++ {
+			if d := retryDelay(attempt); d < base || d > base+base/2 {
+				t.Fatalf("retryDelay(%d) = %v, want within [%v, %v]", attempt, d, base, base+base/2)
+			}
+		}
+	}
+}
+
+func TestNextPageURL(t *testing.T) {
+	for _, tt := range []struct {
+		link string
+		want string
+	}{
+		{"", ""},
+		{`<https://api.github.com/x?page=2>; rel="next", <https://api.github.com/x?page=5>; rel="last"`, "https://api.github.com/x?page=2"},
+		{`<https://api.github.com/x?page=1>; rel="prev", <https://api.github.com/x?page=1>; rel="first"`, ""},
+		{`<https://api.github.com/x?page=1>; rel="first",<https://api.github.com/x?page=3>; rel="next"`, "https://api.github.com/x?page=3"},
+	} {
+		if got := nextPageURL(tt.link); got != tt.want {
+			t.Errorf("nextPageURL(%q) = %q, want %q", tt.link, got, tt.want)
+		}
+	}
+}
+
+// pipelineRun is what one run of the pipeline over fixtureRepos produced.
+type pipelineRun struct {
+	stats        Stats
+	hashRegistry HashRegistry
+	manifest     []byte
+	hashedFiles  []string
+	hashDir      string
+}
+
+// fixtureRepos serves n repositories whose Cargo.toml files share
+// dependency groups, so that most hashes have several sources. Responses
+// are delayed so that concurrent downloads of earlier repositories
+// finish after later ones.
+func fixtureRepos(t *testing.T, n int) []RepoInfo {
+	t.Helper()
+	groups := []string{
+		"serde = \"1\"\nserde_json = \"1\"\n",
+		"tokio = { version = \"1\", features = [\"full\"] }\n",
+		"anyhow = \"1\"\n",
+		"rand = \"0.8\"\nrand_chacha = \"0.3\"\n",
+	}
+	manifests := make(map[string]string)
+	delays := make(map[string]time.Duration)
+	var repos []RepoInfo
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("crate%02d", i)
+		path := "/acme/" + name + "/main/Cargo.toml"
+		delays[path] = time.Duration((n-i)%5) * time.Millisecond
+		manifests[path] = fmt.Sprintf(
+			"[package]\nname = %q\n\n[dependencies]\n%s\n%s\n[dev-dependencies]\n%s",
+			name, groups[i%4], groups[(i+1)%4], groups[i%3])
+		repos = append(repos, RepoInfo{Name: name, FullName: "acme/" + name, DefaultBranch: "main"})
+	}
+	fakeGitHub(t, notFound, func(w http.ResponseWriter, r *http.Request) {
+		content, ok := manifests[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		time.Sleep(delays[r.URL.Path])
+		io.WriteString(w, content)
+	})
+	return repos
+}
+
+// runPipeline fetches and records repos at the given concurrency into a
+// fresh output directory, the way run does, and writes the manifest.
+func runPipeline(t *testing.T, repos []RepoInfo, concurrency int) pipelineRun {
+	t.Helper()
+	return runPipelineIn(t, t.TempDir(), repos, concurrency)
+}
+
+// runPipelineIn is runPipeline writing to output, which may hold the
+// results of a previous run.
+func runPipelineIn(t *testing.T, output string, repos []RepoInfo, concurrency int) pipelineRun {
+	t.Helper()
+	cfg := &config{concurrency: concurrency, owners: stringList{"acme"}}
+	paths, err := outputLayout(output, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := paths.create(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := newPipeline(cfg, paths, &repoSelection{repos: repos, ignore: &snippetIgnore{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range p.fetch() {
+		if err := p.record(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.carryOver()
+	countHashes(&p.stats, p.out.hashRegistry)
+
+	if err := saveManifest(paths.manifestPath, p.out.hashRegistry, p.out.snippetIndex, p.out.sources); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := os.ReadFile(paths.manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(paths.hashDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hashedFiles []string
+	for _, entry := range entries {
+		hashedFiles = append(hashedFiles, entry.Name())
+	}
+	return pipelineRun{p.stats, p.out.hashRegistry, manifest, hashedFiles, paths.hashDir}
+}
+
+// TestConcurrentFetchMatchesSequential checks that fetching in parallel
+// leaves no trace in the results: the registry pass over them must give
+// the same counts, hash registry and manifest as a sequential run. Run it
+// with -race.
+func TestConcurrentFetchMatchesSequential(t *testing.T) {
+	repos := fixtureRepos(t, 16)
+
+	sequential := runPipeline(t, repos, 1)
+	if sequential.stats.Downloaded != len(repos) {
+		t.Fatalf("downloaded %d of %d repositories", sequential.stats.Downloaded, len(repos))
+	}
+	if sequential.stats.UniqueHashes >= sequential.stats.GroupsExtracted {
+		t.Fatalf("fixtures share no groups: %d unique hashes for %d groups",
+			sequential.stats.UniqueHashes, sequential.stats.GroupsExtracted)
+	}
+
+	for i := 0; i < 3; i++ {
+		concurrent := runPipeline(t, repos, 8)
+		if !reflect.DeepEqual(concurrent.stats, sequential.stats) {
+			t.Errorf("stats differ:\nconcurrent: %+v\nsequential: %+v", concurrent.stats, sequential.stats)
+		}
+		if !reflect.DeepEqual(concurrent.hashRegistry, sequential.hashRegistry) {
+			t.Errorf("hash registries differ:\nconcurrent: %v\nsequential: %v", concurrent.hashRegistry, sequential.hashRegistry)
+		}
+		if !bytes.Equal(concurrent.manifest, sequential.manifest) {
+			t.Errorf("manifests differ:\nconcurrent: %s\nsequential: %s", concurrent.manifest, sequential.manifest)
+		}
+		if !reflect.DeepEqual(concurrent.hashedFiles, sequential.hashedFiles) {
+			t.Errorf("hashed snippets differ:\nconcurrent: %v\nsequential: %v", concurrent.hashedFiles, sequential.hashedFiles)
+		}
+	}
+}
+
+// serveManifests serves each of manifests, keyed by repository name, as the
+// Cargo.toml of acme/<name> on main, and returns those repositories.
+func serveManifests(t *testing.T, manifests map[string]string) map[string]RepoInfo {
+	t.Helper()
+	repos := make(map[string]RepoInfo)
+	for name := range manifests {
+		repos[name] = RepoInfo{Name: name, FullName: "acme/" + name, DefaultBranch: "main"}
+	}
+	fakeGitHub(t, notFound, func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/acme/"), "/main/Cargo.toml")
+		content, ok := manifests[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, content)
+	})
+	return repos
+}
+
+// hashedSnippets returns the contents of the {hash}.toml files of run, by
+// file name.
+func hashedSnippets(t *testing.T, run pipelineRun) map[string]string {
+	t.Helper()
+	snippets := make(map[string]string)
+	for _, name := range run.hashedFiles {
+		if !strings.HasSuffix(name, ".toml") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(run.hashDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		snippets[name] = string(data)
+	}
+	return snippets
+}
+
+// TestLineEndingsDoNotAffectSnippets checks that a Windows-edited manifest
+// produces byte-identical hashed snippets to its LF original.
+func TestLineEndingsDoNotAffectSnippets(t *testing.T) {
+	lf := "[package]\nname = \"x\"\n\n[dependencies]\nserde = { version = \"1\", features = [\n    \"derive\",\n] }\nserde_json = \"1\"\n\ntokio = \"1\"\n\n[dev-dependencies]\nrand = \"0.8\"\n"
+	repos := serveManifests(t, map[string]string{
+		"lf":   lf,
+		"crlf": strings.ReplaceAll(lf, "\n", "\r\n"),
+	})
+
+	want := runPipeline(t, []RepoInfo{repos["lf"]}, 1)
+	got := runPipeline(t, []RepoInfo{repos["crlf"]}, 1)
+	if len(want.hashRegistry) == 0 {
+		t.Fatal("no snippets were saved")
+	}
+	for hash := range want.hashRegistry {
+		if _, ok := got.hashRegistry[hash]; !ok {
+			t.Errorf("hash %s of the LF manifest is missing for CRLF; got %v", hash, got.hashRegistry)
+		}
+	}
+	if len(got.hashRegistry) != len(want.hashRegistry) {
+		t.Errorf("CRLF manifest produced %d hashes, want %d", len(got.hashRegistry), len(want.hashRegistry))
+	}
+	if gotSnippets, wantSnippets := hashedSnippets(t, got), hashedSnippets(t, want); !reflect.DeepEqual(gotSnippets, wantSnippets) {
+		t.Errorf("hashed snippets differ:\nCRLF: %q\nLF:   %q", gotSnippets, wantSnippets)
+	}
+	for _, text := range hashedSnippets(t, got) {
+		if strings.Contains(text, "\r") {
+			t.Errorf("hashed snippet keeps a carriage return: %q", text)
+		}
+	}
+}
+
+func TestBOMManifestHashesLikePlainOne(t *testing.T) {
+	plain := "[dependencies]\nserde = \"1\"\n\ntokio = \"1\"\n"
+	repos := serveManifests(t, map[string]string{
+		"plain": plain,
+		"bom":   "\ufeff" + plain,
+	})
+
+	content, _, _, err := downloadCargoToml("acme", "bom", "main", "Cargo.toml", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != plain {
+		t.Errorf("downloaded %q, want the BOM stripped: %q", content, plain)
+	}
+
+	want := runPipeline(t, []RepoInfo{repos["plain"]}, 1)
+	got := runPipeline(t, []RepoInfo{repos["bom"]}, 1)
+	if got.stats.SectionsExtracted != 1 || got.stats.GroupsExtracted != 2 {
+		t.Errorf("BOM manifest: %d sections and %d groups extracted, want 1 and 2",
+			got.stats.SectionsExtracted, got.stats.GroupsExtracted)
+	}
+	if gotSnippets, wantSnippets := hashedSnippets(t, got), hashedSnippets(t, want); !reflect.DeepEqual(gotSnippets, wantSnippets) {
+		t.Errorf("hashed snippets differ:\nBOM:   %q\nplain: %q", gotSnippets, wantSnippets)
+	}
+}
+
+// TestSidecarListsEachSourceOnce saves a group that a manifest declares
+// twice, byte for byte, and then runs again over the same output: the
+// {hash}.json sidecar must list every source once.
+func TestSidecarListsEachSourceOnce(t *testing.T) {
+	group := "serde = \"1\"\nserde_json = \"1\"\n"
+	repos := serveManifests(t, map[string]string{
+		"a": "[dependencies]\n" + group + "\n[build-dependencies]\n" + group,
+		"b": "[dependencies]\n" + group,
+	})
+	output := t.TempDir()
+
+	for run := 1; run <= 2; run++ {
+		result := runPipelineIn(t, output, []RepoInfo{repos["a"], repos["b"]}, 2)
+		if len(result.hashRegistry) != 1 {
+			t.Fatalf("run %d: %d hashes, want 1: %v", run, len(result.hashRegistry), result.hashRegistry)
+		}
+		for shortHash := range result.hashRegistry {
+			meta, found, _, err := readHashedMeta(filepath.Join(result.hashDir, shortHash+".toml"))
+			if err != nil || !found {
+				t.Fatalf("run %d: reading sidecar of %s: found %v, err %v", run, shortHash, found, err)
+			}
+			want := []string{"acme/a/build-dependencies/group01", "acme/a/dependencies/group01", "acme/b/dependencies/group01"}
+			if !reflect.DeepEqual(meta.Sources, want) {
+				t.Errorf("run %d: sidecar sources = %q, want %q", run, meta.Sources, want)
+			}
+		}
+	}
+}
+
+func TestSaveHashedSnippetMergesSources(t *testing.T) {
+	hashDir := t.TempDir()
+	content := "serde = \"1\"\n"
+	var path string
+	for _, sources := range [][]string{
+		{"acme/a"},
+		{"acme/a", "acme/a"},
+		{"acme/b", "acme/a"},
+	} {
+		var err error
+		if path, _, err = saveHashedSnippet(hashDir, content, sources); err != nil {
+			t.Fatal(err)
+		}
+	}
+	meta, _, _, err := readHashedMeta(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"acme/a", "acme/b"}; !reflect.DeepEqual(meta.Sources, want) {
+		t.Errorf("sources = %q, want %q", meta.Sources, want)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != renderSnippet(content) {
+		t.Errorf("%s = %q, %v; want %q", path, data, err, renderSnippet(content))
+	}
+}
+
+// gzipped serves body gzip-compressed, failing the test unless the request
+// advertised gzip support.
+func gzipped(t *testing.T, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			t.Errorf("%s: Accept-Encoding = %q, want gzip", r.URL.Path, r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		io.WriteString(zw, body)
+		zw.Close()
+	}
+}
+
+func TestGzipResponsesAreDecoded(t *testing.T) {
+	manifest := "[dependencies]\nserde = \"1\"\n"
+	fakeGitHub(t,
+		gzipped(t, `{"total_count": 1, "items": [{"name": "a", "full_name": "acme/a"}]}`),
+		gzipped(t, manifest))
+
+	var search GitHubSearchResponse
+	if _, err := getGitHubPage(apiBase+"/search/repositories", "search", &search); err != nil {
+		t.Fatal(err)
+	}
+	if got := repoNames(search.Items); got != "acme/a" {
+		t.Errorf("search items = %s, want acme/a", got)
+	}
+
+	content, _, _, err := downloadCargoToml("acme", "a", "main", "Cargo.toml", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != manifest {
+		t.Errorf("content = %q, want %q", content, manifest)
+	}
+}
+
+// masterOnlyWorkspace serves acme/ws, a repository that only has a master
+// branch, with root as its Cargo.toml and member manifests in crates/a,
+// crates/b and tools/gen. It returns the repository, whose default branch is
+// recorded as main, and a func listing the paths requested so far.
+func masterOnlyWorkspace(t *testing.T, root string) (RepoInfo, func() []string) {
+	t.Helper()
+	files := map[string]string{
+		"/acme/ws/master/Cargo.toml":           root,
+		"/acme/ws/master/crates/a/Cargo.toml":  "[dependencies]\nserde = \"1\"\n",
+		"/acme/ws/master/crates/b/Cargo.toml":  "[dependencies]\ntokio = \"1\"\n",
+		"/acme/ws/master/tools/gen/Cargo.toml": "[dependencies]\nclap = \"4\"\n",
+	}
+	var mu sync.Mutex
+	var requested []string
+	record := func(r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.URL.Path)
+		mu.Unlock()
+	}
+	fakeGitHub(t, func(w http.ResponseWriter, r *http.Request) {
+		record(r)
+		if r.URL.Path != "/repos/acme/ws/git/trees/master" {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, `{"tree": [
+			{"path": "Cargo.toml", "type": "blob"},
+			{"path": "crates", "type": "tree"},
+			{"path": "crates/a/Cargo.toml", "type": "blob"},
+			{"path": "crates/b/Cargo.toml", "type": "blob"},
+			{"path": "tools/gen/Cargo.toml", "type": "blob"}
+		]}`)
+	}, func(w http.ResponseWriter, r *http.Request) {
+		record(r)
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, content)
+	})
+	return RepoInfo{Name: "ws", FullName: "acme/ws", DefaultBranch: "main"}, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), requested...)
+	}
+}
+
+// memberBranches returns "member@branch" for every manifest of result.
+func memberBranches(t *testing.T, result repoResult) string {
+	t.Helper()
+	if result.err != nil || result.treeErr != nil {
+		t.Fatalf("processRepo: err %v, tree err %v", result.err, result.treeErr)
+	}
+	var got []string
+	for _, m := range result.manifests {
+		if m.err != nil {
+			t.Errorf("%s: %v", m.member, m.err)
+		}
+		got = append(got, m.member+"@"+m.branch)
+	}
+	return strings.Join(got, ",")
+}
+
+func TestMonorepoReadsNestedManifestsFromRootBranch(t *testing.T) {
+	repo, requested := masterOnlyWorkspace(t, "[workspace]\n")
+	result := processRepo(repo, "ws", fetchOptions{cargoTomlsDir: t.TempDir(), monorepo: true})
+
+	if got, want := memberBranches(t, result), "@master,crates/a@master,crates/b@master,tools/gen@master"; got != want {
+		t.Errorf("manifests = %s, want %s", got, want)
+	}
+	for _, path := range requested() {
+		if strings.Contains(path+"/", "/main/") && path != "/acme/ws/main/Cargo.toml" {
+			t.Errorf("requested %s; only the root manifest should be tried on main", path)
+		}
+	}
+}
+
+func TestWorkspaceMemberGlobsExpandOnRootBranch(t *testing.T) {
+	repo, requested := masterOnlyWorkspace(t, "[workspace]\nmembers = [\"crates/*\"]\nexclude = [\"crates/b\"]\n")
+	result := processRepo(repo, "ws", fetchOptions{cargoTomlsDir: t.TempDir(), members: true})
+
+	if got, want := memberBranches(t, result), "@master,crates/a@master"; got != want {
+		t.Errorf("manifests = %s, want %s", got, want)
+	}
+	var trees []string
+	for _, path := range requested() {
+		if strings.Contains(path, "/git/trees/") {
+			trees = append(trees, path)
+		}
+	}
+	if want := []string{"/repos/acme/ws/git/trees/master"}; !reflect.DeepEqual(trees, want) {
+		t.Errorf("tree listings = %q, want %q", trees, want)
+	}
+}
+
+func TestWorkspaceMembersWithoutGlobsSkipTreeListing(t *testing.T) {
+	repo, requested := masterOnlyWorkspace(t, "[workspace]\nmembers = [\"crates/a\", \"tools/gen\"]\n")
+	result := processRepo(repo, "ws", fetchOptions{cargoTomlsDir: t.TempDir(), members: true})
+
+	if got, want := memberBranches(t, result), "@master,crates/a@master,tools/gen@master"; got != want {
+		t.Errorf("manifests = %s, want %s", got, want)
+	}
+	for _, path := range requested() {
+		if strings.Contains(path, "/git/trees/") {
+			t.Errorf("listed the tree (%s) although no member is a glob", path)
+		}
+	}
+}
+
+func TestDottedDeclarationsAreNotDuplicates(t *testing.T) {
+	workspace := map[string]cargosnip.Dependency{"tokio": {Name: "tokio", Version: "1.38"}}
+	groups := []string{
+		"tokio.workspace = true\ntokio.features = [\"full\"]\nserde.version = \"1\"\nserde.features = [\"derive\"]",
+		"rand = \"0.8\"\nrand = \"0.9\"",
+	}
+	uses := collectDependencyUses("acme/a", "dependencies", groups, workspace)
+
+	var got []string
+	for _, use := range uses {
+		got = append(got, use.Name+"@"+use.Version)
+	}
+	if want := "tokio@1.38,serde@1,rand@0.8,rand@0.9"; strings.Join(got, ",") != want {
+		t.Errorf("uses = %s, want %s", strings.Join(got, ","), want)
+	}
+
+	duplicates := duplicateDeclarations(uses)
+	if len(duplicates) != 1 || duplicates[0][0].Name != "rand" {
+		t.Errorf("duplicates = %+v, want only rand", duplicates)
+	}
+}